@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+)
+
+// loopbackListen listens on addr. addr must be localhost or loopback address
+func loopbackListen(addr string) (net.Listener, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil, fmt.Errorf("not loopback address: %s", addr)
+	}
+	return net.Listen("tcp", addr)
+}
+
+// serveAdmin serves admin view on addr in background
+func serveAdmin(addr string, path string, hdl http.Handler) error {
+	l, err := loopbackListen(addr)
+	if err != nil {
+		return err
+	}
+	var mux http.ServeMux
+	mux.Handle(path, hdl)
+	slog.Info("admin listen", "addr", l.Addr(), "path", path)
+	go func() {
+		if err := http.Serve(l, &mux); err != nil {
+			slog.Error("admin serve", "error", err)
+		}
+	}()
+	return nil
+}
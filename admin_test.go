@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestLoopbackListen(t *testing.T) {
+	t.Parallel()
+	for _, addr := range []string{"localhost:", "127.0.0.1:0"} {
+		l, err := loopbackListen(addr)
+		if err != nil {
+			t.Error("listen", addr, err)
+			continue
+		}
+		l.Close()
+	}
+	for _, addr := range []string{":0", "0.0.0.0:0", "[::]:0", "192.0.2.1:0", "example.com:0", "localhost"} {
+		if l, err := loopbackListen(addr); err == nil {
+			l.Close()
+			t.Error("listen", addr)
+		}
+	}
+}
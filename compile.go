@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"path/filepath"
+	"strings"
+)
+
+// compileCommand is "compile" subcommand. options are shared with the server
+type compileCommand struct{}
+
+// Compiler is optional interface of Runner which compiles the script ahead of time
+type Compiler interface {
+	Compile(conf SrvConfig, cmdname string) error
+}
+
+// compileScripts compiles every script under base dir with suffix (.wasm if not set).
+// per-route options are applied to each script as the server does
+func compileScripts(conf SrvConfig, runner Runner) error {
+	c, ok := runner.(Compiler)
+	if !ok {
+		return fmt.Errorf("runner %s cannot compile", conf.Runner)
+	}
+	suffix := conf.Suffix
+	if suffix == "" {
+		suffix = ".wasm"
+	}
+	var errs []error
+	count := 0
+	err := filepath.WalkDir(conf.BaseDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() || !strings.HasSuffix(d.Name(), suffix) {
+			return nil
+		}
+		cmdname, err := filepath.Rel(conf.BaseDir, path)
+		if err != nil {
+			return err
+		}
+		cmdname = filepath.ToSlash(cmdname)
+		sconf, err := conf.ForScript(cmdname)
+		if err == nil {
+			err = c.Compile(sconf, cmdname)
+		}
+		if err != nil {
+			slog.Error("compile", "error", err, "script", cmdname)
+			errs = append(errs, fmt.Errorf("%s: %w", cmdname, err))
+			return nil
+		}
+		count++
+		return nil
+	})
+	if err != nil {
+		errs = append(errs, err)
+	}
+	slog.Info("compile done", "compiled", count, "failed", len(errs))
+	return errors.Join(errs...)
+}
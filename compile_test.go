@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// compileRunner records compiled scripts with their timeout
+type compileRunner struct {
+	compiled map[string]time.Duration
+}
+
+func (r *compileRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
+	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
+	return nil
+}
+
+func (r *compileRunner) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
+	return path, "", nil
+}
+
+func (r *compileRunner) Compile(conf SrvConfig, cmdname string) error {
+	if cmdname == "broken.wasm" {
+		return errors.New("broken")
+	}
+	r.compiled[cmdname] = conf.Timeout
+	return nil
+}
+
+func TestCompileScripts(t *testing.T) {
+	t.Parallel()
+	conf := SrvConfig{}
+	conf.Timeout = time.Minute
+	conf.BaseDir = t.TempDir()
+	conf.routes = []routeConfig{{Path: "sub/*", Options: map[string]any{"timeout": "1h"}}}
+	for _, fname := range []string{"a.wasm", "sub/b.wasm", "sub/c.cgi", "README"} {
+		fn := filepath.Join(conf.BaseDir, fname)
+		if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+			t.Fatal("mkdir", err)
+		}
+		if err := os.WriteFile(fn, nil, 0644); err != nil {
+			t.Fatal("writefile", err)
+		}
+	}
+	runner := &compileRunner{compiled: map[string]time.Duration{}}
+	if err := compileScripts(conf, runner); err != nil {
+		t.Error("compile", err)
+	}
+	if len(runner.compiled) != 2 || runner.compiled["a.wasm"] != time.Minute || runner.compiled["sub/b.wasm"] != time.Hour {
+		t.Error("compiled", runner.compiled)
+	}
+	conf.Suffix = ".cgi"
+	runner.compiled = map[string]time.Duration{}
+	if err := compileScripts(conf, runner); err != nil {
+		t.Error("compile", err)
+	}
+	if _, ok := runner.compiled["sub/c.cgi"]; !ok || len(runner.compiled) != 1 {
+		t.Error("suffix", runner.compiled)
+	}
+	conf.Suffix = ""
+	if err := os.WriteFile(filepath.Join(conf.BaseDir, "broken.wasm"), nil, 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	runner.compiled = map[string]time.Duration{}
+	if err := compileScripts(conf, runner); err == nil || len(runner.compiled) != 2 {
+		t.Error("broken", err, runner.compiled)
+	}
+	if err := compileScripts(conf, &OsRunner{}); err == nil {
+		t.Error("not compiler")
+	}
+}
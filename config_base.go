@@ -1,18 +1,51 @@
 package main
 
-import "time"
+import (
+	"time"
+
+	"github.com/docker/go-units"
+)
+
+// ByteSize is size in bytes, parsed from human readable string like "64m"
+type ByteSize int64
+
+// UnmarshalFlag implements flags.Unmarshaler
+func (b *ByteSize) UnmarshalFlag(value string) error {
+	v, err := units.RAMInBytes(value)
+	if err != nil {
+		return err
+	}
+	*b = ByteSize(v)
+	return nil
+}
 
 type SrvConfigBase struct {
-	Verbose      bool          `short:"v" long:"verbose" description:"log verbose"`
-	Quiet        bool          `short:"q" long:"quiet" description:"log quiet"`
-	Addr         string        `short:"l" long:"listen" default:"localhost:" value-name:"[host]:port"`
-	Proto        string        `long:"protocol" default:"tcp" value-name:"tcp/unix"`
-	Prefix       string        `short:"p" long:"prefix" default:"/" value-name:"url-prefix"`
-	BaseDir      string        `short:"b" long:"base-dir" default:"." value-name:"dirname"`
-	Suffix       string        `short:"s" long:"suffix" value-name:".ext"`
-	JSONLog      bool          `long:"json-log"`
-	Runner       string        `long:"runner" default:"os" value-name:"name"`
-	Version      bool          `short:"V" long:"version"`
-	OtelProvider string        `long:"opentelemetry" choice:"stdout" choice:"otlp" choice:"otlp-http"`
-	Timeout      time.Duration `short:"t" long:"timeout" default:"1m"`
+	Verbose       bool          `short:"v" long:"verbose" description:"log verbose"`
+	Quiet         bool          `short:"q" long:"quiet" description:"log quiet"`
+	Addr          string        `short:"l" long:"listen" default:"localhost:" value-name:"[host]:port"`
+	Proto         string        `long:"protocol" default:"tcp" value-name:"tcp/unix"`
+	Prefix        string        `short:"p" long:"prefix" default:"/" value-name:"url-prefix"`
+	BaseDir       string        `short:"b" long:"base-dir" default:"." value-name:"dirname"`
+	Suffix        string        `short:"s" long:"suffix" value-name:".ext"`
+	JSONLog       bool          `long:"json-log"`
+	Runner        string        `long:"runner" default:"os" value-name:"name"`
+	Version       bool          `short:"V" long:"version"`
+	OtelProvider  string        `long:"opentelemetry" choice:"stdout" choice:"otlp" choice:"otlp-http"`
+	Timeout       time.Duration `short:"t" long:"timeout" default:"1m"`
+	KillGrace     time.Duration `long:"kill-grace" default:"5s" description:"wait before SIGKILL after SIGTERM"`
+	HeaderTimeout time.Duration `long:"header-timeout" description:"time limit to emit CGI headers"`
+	IdleTimeout   time.Duration `long:"idle-timeout" description:"time limit without stdout progress"`
+	RouteConfig   string        `long:"route-config" value-name:"filename" description:"per-route options (json)"`
+	Subreaper     bool          `long:"subreaper" description:"reap orphaned processes as child subreaper"`
+	AdminPath     string        `long:"admin-path" value-name:"path" description:"serve admin view of the runner (disabled if empty)"`
+	AdminAddr     string        `long:"admin-listen" default:"localhost:" value-name:"[host]:port" description:"address of admin view (loopback only)"`
+	Env           []string      `long:"env" value-name:"KEY=VALUE" description:"environment variable for scripts"`
+	InheritEnv    []string      `long:"inherit-env" value-name:"NAME" description:"environment variable passed from httpcgi (glob)"`
+	EnvFile       []string      `long:"env-file" value-name:"KEY=filename" description:"environment variable read from file"`
+	WorkDir       string        `long:"work-dir" default:"script" value-name:"script|base|dirname" description:"working directory of scripts"`
+	ScratchDir    string        `long:"scratch-dir" value-name:"dirname" description:"parent of per-request TMPDIR"`
+	ScratchQuota  ByteSize      `long:"scratch-quota" value-name:"size" description:"size limit of per-request TMPDIR"`
+	WasmConfig
+
+	routes []routeConfig
 }
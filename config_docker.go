@@ -2,9 +2,29 @@
 
 package main
 
+import "time"
+
 // SrvConfig is configuration. set by argument parser
 type SrvConfig struct {
 	SrvConfigBase
-	DockerMounts  []string `long:"docker-volume"`
-	DockerWorkDir string   `long:"docker-workdir"`
+	DockerMounts      []string      `long:"docker-volume"`
+	DockerWorkDir     string        `long:"docker-workdir"`
+	DockerMemory      ByteSize      `long:"docker-memory" default:"256m" value-name:"size" description:"memory limit of container"`
+	DockerCPUs        float64       `long:"docker-cpus" default:"1" description:"cpu limit of container"`
+	DockerPidsLimit   int64         `long:"docker-pids-limit" default:"64" description:"pids limit of container"`
+	DockerWritable    bool          `long:"docker-writable-rootfs" description:"do not mount rootfs read-only"`
+	DockerNetwork     string        `long:"docker-network" default:"none" description:"network mode of container"`
+	DockerCapAdd      []string      `long:"docker-cap-add" value-name:"CAP" description:"capability to add (all dropped by default)"`
+	DockerUser        string        `long:"docker-user" value-name:"user[:group]" description:"user to run container"`
+	DockerLabel       bool          `long:"docker-require-label" description:"run only images labeled httpcgi.enable=true"`
+	DockerPool        int           `long:"docker-pool" value-name:"N" description:"keep N containers per image and run requests by exec"`
+	DockerPoolMaxUses int           `long:"docker-pool-max-uses" default:"100" value-name:"M" description:"recycle pooled container after M requests"`
+	DockerPoolCheck   time.Duration `long:"docker-pool-check" default:"30s" description:"interval of health check of pooled containers"`
+	DockerPoolIdleCmd string        `long:"docker-pool-idle-cmd" default:"sleep infinity" description:"command to keep pooled container running"`
+	DockerInstance    string        `long:"docker-instance" value-name:"name" description:"label of containers created by this instance (default: hostname and random suffix)"`
+	DockerGC          time.Duration `long:"docker-gc" description:"interval to remove orphaned containers of --docker-instance (disabled if 0)"`
+	DockerPullAllow   []string      `long:"docker-pull-allow" value-name:"pattern" description:"pull missing image matching the pattern (registry/ or repository)"`
+	DockerPullTimeout time.Duration `long:"docker-pull-timeout" default:"5m" description:"timeout of pulling image"`
+	DockerPullDigest  bool          `long:"docker-pull-require-digest" description:"pull only images pinned by digest"`
+	DockerResync      time.Duration `long:"docker-resync" default:"5m" description:"interval to resync image index"`
 }
@@ -0,0 +1,6 @@
+//go:build !wazero && !wasmtime && !wasmer
+
+package main
+
+// WasmConfig is configuration of WASM runners. empty without WASM runners
+type WasmConfig struct{}
@@ -0,0 +1,22 @@
+//go:build wazero || wasmtime || wasmer
+
+package main
+
+import "time"
+
+// WasmConfig is configuration of WASM runners
+type WasmConfig struct {
+	WasmCacheSize       int             `long:"wasm-cache-size" default:"64" value-name:"N" description:"number of compiled modules to keep"`
+	WasmCacheDir        string          `long:"wasm-cache-dir" value-name:"dirname" description:"persist compiled modules (wazero)"`
+	WasmMaxMemory       ByteSize        `long:"wasm-max-memory" value-name:"size" description:"linear memory limit of the module"`
+	WasmPreopen         []wasmPreopen   `long:"wasm-preopen" value-name:"host:guest[:ro]" description:"directory mapped into the module"`
+	WasmKVFile          string          `long:"wasm-kv-file" value-name:"filename" description:"key-value store of the host module, set per route (wazero)"`
+	WasmHTTPAllow       []wasmHTTPAllow `long:"wasm-http-allow" value-name:"[METHOD,...=]scheme://host[:port]" description:"outbound HTTP allowed for the module (wazero)"`
+	WasmHTTPTimeout     time.Duration   `long:"wasm-http-timeout" default:"10s" description:"timeout of outbound HTTP (wazero)"`
+	WasmHTTPMaxResponse ByteSize        `long:"wasm-http-max-response" default:"1m" value-name:"size" description:"size limit of outbound HTTP response (wazero)"`
+	WasmProfile         bool            `long:"wasm-profile" description:"record host calls and CPU profile of the module, set per route (wazero)"`
+	WasmProfileDir      string          `long:"wasm-profile-dir" value-name:"dirname" description:"save CPU profile of each script in pprof format (wazero)"`
+	WasmProfileInterval time.Duration   `long:"wasm-profile-interval" default:"10ms" description:"sampling interval of CPU profile (wazero)"`
+	WagiConfig          string          `long:"wagi-config" value-name:"modules.toml" description:"route map of WAGI modules (wagi)"`
+	WasmFuel            uint64          `long:"wasm-fuel" value-name:"N" description:"fuel to run the module, roughly number of instructions (wasmtime)"`
+}
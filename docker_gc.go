@@ -0,0 +1,185 @@
+//go:build docker
+
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/client"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	labelInstance = labelPrefix + "instance"
+	labelScript   = labelPrefix + "script"
+	labelRequest  = labelPrefix + "request"
+	labelTrace    = labelPrefix + "trace"
+	labelPool     = labelPrefix + "pool"
+)
+
+// orphanGrace is age of untracked container to be removed.
+// container just created may not be tracked yet
+const orphanGrace = time.Minute
+
+// containerTracker labels containers created by this instance and removes orphaned ones
+type containerTracker struct {
+	instance string
+	mu       sync.Mutex
+	live     map[string]struct{}
+}
+
+func newContainerTracker(instance string) *containerTracker {
+	return &containerTracker{instance: instance, live: map[string]struct{}{}}
+}
+
+// labels returns labels of container for the request
+func (tr *containerTracker) labels(script string, envvar map[string]string, ctx context.Context) map[string]string {
+	if tr == nil {
+		return nil
+	}
+	reqid := envvar["HTTP_X_REQUEST_ID"]
+	if reqid == "" {
+		reqid = rand.Text()
+	}
+	res := map[string]string{
+		labelInstance: tr.instance,
+		labelScript:   script,
+		labelRequest:  reqid,
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.HasTraceID() {
+		res[labelTrace] = sc.TraceID().String()
+	}
+	return res
+}
+
+// poolLabels returns labels of pooled container
+func (tr *containerTracker) poolLabels(script string) map[string]string {
+	if tr == nil {
+		return nil
+	}
+	return map[string]string{
+		labelInstance: tr.instance,
+		labelScript:   script,
+		labelPool:     "true",
+	}
+}
+
+func (tr *containerTracker) add(id string) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	tr.live[id] = struct{}{}
+}
+
+func (tr *containerTracker) remove(id string) {
+	if tr == nil {
+		return
+	}
+	tr.mu.Lock()
+	defer tr.mu.Unlock()
+	delete(tr.live, id)
+}
+
+// list returns containers of this instance
+func (tr *containerTracker) list(ctx context.Context, cli client.APIClient) ([]container.Summary, error) {
+	return cli.ContainerList(ctx, container.ListOptions{
+		All:     true,
+		Filters: filters.NewArgs(filters.Arg("label", labelInstance+"="+tr.instance)),
+	})
+}
+
+// gc force-removes containers of this instance which are not tracked
+func (tr *containerTracker) gc(ctx context.Context, cli client.APIClient) error {
+	conts, err := tr.list(ctx, cli)
+	if err != nil {
+		return err
+	}
+	deadline := time.Now().Add(-orphanGrace).Unix()
+	for _, c := range conts {
+		tr.mu.Lock()
+		_, ok := tr.live[c.ID]
+		tr.mu.Unlock()
+		if ok || c.Created > deadline {
+			continue
+		}
+		slog.Info("remove orphan", "id", c.ID, "script", c.Labels[labelScript], "state", c.State)
+		if err := cli.ContainerRemove(ctx, c.ID, container.RemoveOptions{Force: true}); err != nil && !client.IsErrNotFound(err) {
+			slog.Error("remove orphan", "id", c.ID, "error", err)
+		}
+	}
+	return nil
+}
+
+// watch runs gc at startup and periodically
+func (tr *containerTracker) watch(ctx context.Context, cli client.APIClient, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := tr.gc(ctx, cli); err != nil {
+			slog.Error("container gc", "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// containerView is an entry of admin view
+type containerView struct {
+	ID      string    `json:"id"`
+	Image   string    `json:"image"`
+	Script  string    `json:"script"`
+	Request string    `json:"request,omitempty"`
+	Trace   string    `json:"trace,omitempty"`
+	Pool    bool      `json:"pool,omitempty"`
+	State   string    `json:"state"`
+	Status  string    `json:"status"`
+	Created time.Time `json:"created"`
+	Tracked bool      `json:"tracked"`
+}
+
+// handler returns admin view listing containers of this instance as JSON
+func (tr *containerTracker) handler(cli client.APIClient) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conts, err := tr.list(r.Context(), cli)
+		if err != nil {
+			slog.Error("container list", "error", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		res := []containerView{}
+		for _, c := range conts {
+			tr.mu.Lock()
+			_, tracked := tr.live[c.ID]
+			tr.mu.Unlock()
+			res = append(res, containerView{
+				ID:      c.ID,
+				Image:   c.Image,
+				Script:  c.Labels[labelScript],
+				Request: c.Labels[labelRequest],
+				Trace:   c.Labels[labelTrace],
+				Pool:    c.Labels[labelPool] == "true",
+				State:   string(c.State),
+				Status:  c.Status,
+				Created: time.Unix(c.Created, 0),
+				Tracked: tracked,
+			})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(res); err != nil {
+			slog.Error("write admin view", "error", err)
+		}
+	})
+}
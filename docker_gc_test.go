@@ -0,0 +1,168 @@
+//go:build docker
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/golang/mock/gomock"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wtnb75/httpcgi/mock_client"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestContainerTrackerLabels(t *testing.T) {
+	t.Parallel()
+	var tr0 *containerTracker
+	if labels := tr0.labels("path1", map[string]string{}, context.Background()); labels != nil {
+		t.Error("nil tracker", labels)
+	}
+	tr := newContainerTracker("host1")
+	traceID := trace.TraceID{1, 2, 3}
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID, SpanID: trace.SpanID{1},
+	}))
+	labels := tr.labels("path1", map[string]string{"HTTP_X_REQUEST_ID": "req1"}, ctx)
+	if labels[labelInstance] != "host1" || labels[labelScript] != "path1" || labels[labelRequest] != "req1" ||
+		labels[labelTrace] != traceID.String() {
+		t.Error("labels", labels)
+	}
+	labels = tr.labels("path1", map[string]string{}, context.Background())
+	if labels[labelRequest] == "" {
+		t.Error("request id", labels)
+	}
+	if _, ok := labels[labelTrace]; ok {
+		t.Error("trace id", labels)
+	}
+	if labels := tr.poolLabels("path1"); labels[labelPool] != "true" || labels[labelInstance] != "host1" {
+		t.Error("pool labels", labels)
+	}
+}
+
+func TestContainerTrackerGC(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	tr := newContainerTracker("host1")
+	tr.add("tracked")
+	old := time.Now().Add(-time.Hour).Unix()
+	cli.EXPECT().ContainerList(gomock.Any(), gomock.Any()).DoAndReturn(
+		func(ctx context.Context, opts container.ListOptions) ([]container.Summary, error) {
+			if !opts.All || !opts.Filters.ExactMatch("label", labelInstance+"=host1") {
+				t.Error("options", opts)
+			}
+			return []container.Summary{
+				{ID: "tracked", Created: old},
+				{ID: "orphan", Created: old},
+				{ID: "creating", Created: time.Now().Unix()},
+			}, nil
+		})
+	cli.EXPECT().ContainerRemove(gomock.Any(), "orphan", container.RemoveOptions{Force: true}).Return(nil)
+	if err := tr.gc(context.Background(), cli); err != nil {
+		t.Error("gc", err)
+	}
+}
+
+func TestContainerTrackerHandler(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	tr := newContainerTracker("host1")
+	tr.add("id1")
+	cli.EXPECT().ContainerList(gomock.Any(), gomock.Any()).Return([]container.Summary{
+		{ID: "id1", Image: "base/path1:latest", State: container.StateRunning, Labels: map[string]string{
+			labelScript: "path1", labelRequest: "req1",
+		}},
+		{ID: "id2", Image: "base/path2:latest", State: container.StateRunning, Labels: map[string]string{
+			labelScript: "path2", labelPool: "true",
+		}},
+	}, nil)
+	runner := DockerRunner{cli: cli, tracker: tr}
+	w := httptest.NewRecorder()
+	runner.AdminHandler().ServeHTTP(w, httptest.NewRequest("GET", "/admin", nil))
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/json" {
+		t.Error("response", w.Code, w.Header())
+	}
+	var res []containerView
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+		t.Error("json", err)
+	}
+	if len(res) != 2 || res[0].Script != "path1" || res[0].Request != "req1" || !res[0].Tracked ||
+		!res[1].Pool || res[1].Tracked || res[1].State != "running" {
+		t.Error("view", res)
+	}
+}
+
+func TestDockerRunTracked(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	tr := newContainerTracker("host1")
+	runner := DockerRunner{cli: cli, tracker: tr}
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{}, nil)
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").DoAndReturn(
+		func(ctx context.Context, cconf *container.Config, hconf *container.HostConfig,
+			_ *network.NetworkingConfig, _ *ocispec.Platform, _ string) (container.CreateResponse, error) {
+			if cconf.Labels[labelInstance] != "host1" || cconf.Labels[labelScript] != "path1" {
+				t.Error("labels", cconf.Labels)
+			}
+			return container.CreateResponse{ID: "id123"}, nil
+		})
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).DoAndReturn(
+		func(context.Context, string, container.StartOptions) error {
+			if _, ok := tr.live["id123"]; !ok {
+				t.Error("not tracked")
+			}
+			return nil
+		})
+	ch_exit := make(chan container.WaitResponse, 1)
+	ch_err := make(chan error, 1)
+	cli.EXPECT().ContainerWait(gomock.Any(), "id123", container.WaitConditionNotRunning).Return(ch_exit, ch_err)
+	hr, _ := fakeAttach(0, "", "")
+	cli.EXPECT().ContainerAttach(gomock.Any(), "id123", gomock.Any()).Return(hr, nil)
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	ch_exit <- container.WaitResponse{}
+	err := runner.Run(SrvConfig{}, "path1", map[string]string{}, io.NopCloser(&bytes.Buffer{}), &bytes.Buffer{}, &bytes.Buffer{}, context.Background())
+	if err != nil {
+		t.Error("err", err)
+	}
+	if len(tr.live) != 0 {
+		t.Error("still tracked", tr.live)
+	}
+}
+
+func TestDockerInstance(t *testing.T) {
+	t.Parallel()
+	conf := SrvConfig{}
+	conf.DockerInstance = "inst1"
+	conf.DockerGC = time.Minute
+	if instance, err := dockerInstance(conf); err != nil || instance != "inst1" {
+		t.Error("explicit", instance, err)
+	}
+	conf.DockerInstance = ""
+	if _, err := dockerInstance(conf); err == nil {
+		t.Error("gc without instance")
+	}
+	// unique to the process
+	conf.DockerGC = 0
+	a, err := dockerInstance(conf)
+	if err != nil {
+		t.Error("default", err)
+	}
+	b, _ := dockerInstance(conf)
+	if a == b {
+		t.Error("not unique", a, b)
+	}
+}
@@ -0,0 +1,169 @@
+//go:build docker
+
+package main
+
+import (
+	"context"
+	"iter"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+)
+
+// imageIndex is in-memory index of repo tags of local images
+type imageIndex struct {
+	mu   sync.RWMutex
+	tags map[string]indexEntry // repo tag -> image
+}
+
+type indexEntry struct {
+	ID     string
+	Labels map[string]string
+}
+
+func newImageIndex() *imageIndex {
+	return &imageIndex{tags: map[string]indexEntry{}}
+}
+
+// sync rebuilds index from image list
+func (idx *imageIndex) sync(ctx context.Context, cli client.APIClient) error {
+	imgs, err := cli.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return err
+	}
+	tags := map[string]indexEntry{}
+	for _, i := range imgs {
+		for _, t := range i.RepoTags {
+			tags[t] = indexEntry{ID: i.ID, Labels: i.Labels}
+		}
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.tags = tags
+	slog.Debug("image index synced", "tags", len(tags))
+	return nil
+}
+
+// refresh updates tags of single image
+func (idx *imageIndex) refresh(ctx context.Context, cli client.APIClient, id string) error {
+	var tags []string
+	var labels map[string]string
+	insp, err := cli.ImageInspect(ctx, id)
+	if err != nil && !client.IsErrNotFound(err) {
+		return err
+	}
+	if err == nil {
+		id = insp.ID
+		tags = insp.RepoTags
+		if insp.Config != nil {
+			labels = insp.Config.Labels
+		}
+	}
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for t, v := range idx.tags {
+		if v.ID == id {
+			delete(idx.tags, t)
+		}
+	}
+	for _, t := range tags {
+		idx.tags[t] = indexEntry{ID: id, Labels: labels}
+	}
+	slog.Debug("image index refreshed", "id", id, "tags", tags)
+	return nil
+}
+
+// labels returns labels of indexed image tag. false if not indexed
+func (idx *imageIndex) labels(tag string) (map[string]string, bool) {
+	if idx == nil {
+		return nil, false
+	}
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	ent, ok := idx.tags[tag]
+	return ent.Labels, ok
+}
+
+// resolve finds image tag of path. longest prefix wins, rest of path is pathinfo.
+// if requireLabel, only images labeled httpcgi.enable=true are eligible
+func (idx *imageIndex) resolve(prefix, suffix, path string, requireLabel bool) (string, string, bool) {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+	for name, pathinfo := range pathPrefixes(path) {
+		if ent, ok := idx.tags[prefix+name+suffix]; ok && labelEnabled(ent.Labels, requireLabel) {
+			return prefix + name + suffix, pathinfo, true
+		}
+	}
+	return "", "", false
+}
+
+// pathPrefixes yields path and its parents, longest first, with rest of path as pathinfo
+func pathPrefixes(path string) iter.Seq2[string, string] {
+	return func(yield func(string, string) bool) {
+		name := path
+		for {
+			if !yield(name, path[len(name):]) {
+				return
+			}
+			pos := strings.LastIndex(name, "/")
+			if pos <= 0 {
+				return
+			}
+			name = name[:pos]
+		}
+	}
+}
+
+// watch keeps index up to date from docker events, with periodic resync.
+// the index should be synced before the watch, so that requests are served from the start
+func (idx *imageIndex) watch(ctx context.Context, cli client.APIClient, interval time.Duration) {
+	var tick <-chan time.Time
+	if interval > 0 {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	opts := events.ListOptions{Filters: filters.NewArgs(filters.Arg("type", string(events.ImageEventType)))}
+	for reconnect := false; ; reconnect = true {
+		msgs, errs := cli.Events(ctx, opts)
+		// events may be lost while reconnecting
+		if reconnect {
+			if err := idx.sync(ctx, cli); err != nil {
+				slog.Error("image index sync", "error", err)
+			}
+		}
+	loop:
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-tick:
+				if err := idx.sync(ctx, cli); err != nil {
+					slog.Error("image index sync", "error", err)
+				}
+			case msg := <-msgs:
+				switch msg.Action {
+				case events.ActionTag, events.ActionUnTag, events.ActionDelete,
+					events.ActionPull, events.ActionLoad, events.ActionImport:
+					if err := idx.refresh(ctx, cli, msg.Actor.ID); err != nil {
+						slog.Error("image index refresh", "id", msg.Actor.ID, "error", err)
+					}
+				}
+			case err := <-errs:
+				slog.Warn("docker events", "error", err)
+				break loop
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
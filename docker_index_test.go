@@ -0,0 +1,128 @@
+//go:build docker
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/errdefs"
+	"github.com/golang/mock/gomock"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wtnb75/httpcgi/mock_client"
+)
+
+func TestImageIndexResolve(t *testing.T) {
+	t.Parallel()
+	idx := newImageIndex()
+	idx.tags = map[string]indexEntry{
+		"base/a:latest":   {ID: "id1"},
+		"base/a/b:latest": {ID: "id2"},
+		"xyz/c:latest":    {ID: "id3"},
+		"base/d:latest":   {ID: "id4", Labels: map[string]string{"httpcgi.enable": "true"}},
+		"base/d/e:latest": {ID: "id5", Labels: map[string]string{"httpcgi.enable": "false"}},
+	}
+	tests := []struct {
+		path, name, pathinfo string
+		ok                   bool
+	}{
+		{"a", "base/a:latest", "", true},
+		{"a/x/y", "base/a:latest", "/x/y", true},
+		{"a/b", "base/a/b:latest", "", true},
+		{"a/b/c", "base/a/b:latest", "/c", true},
+		{"c", "", "", false},
+		{"", "", "", false},
+		{"d/e", "base/d:latest", "/e", true},
+	}
+	for _, tt := range tests {
+		name, pathinfo, ok := idx.resolve("base/", ":latest", tt.path, false)
+		if name != tt.name || pathinfo != tt.pathinfo || ok != tt.ok {
+			t.Error(tt.path, name, pathinfo, ok)
+		}
+	}
+	// labeled images only
+	if name, _, ok := idx.resolve("base/", ":latest", "a", true); ok {
+		t.Error("not labeled", name)
+	}
+	if name, pathinfo, ok := idx.resolve("base/", ":latest", "d/e", true); name != "base/d:latest" || pathinfo != "/e" || !ok {
+		t.Error("labeled", name, pathinfo, ok)
+	}
+}
+
+func TestImageIndexRefresh(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	idx := newImageIndex()
+	idx.tags = map[string]indexEntry{"old:latest": {ID: "id1"}, "other:latest": {ID: "id2"}}
+	cli.EXPECT().ImageInspect(gomock.Any(), "id1").Return(image.InspectResponse{
+		ID: "id1", RepoTags: []string{"new:latest", "new:v1"},
+		Config: &dockerspec.DockerOCIImageConfig{
+			ImageConfig: ocispec.ImageConfig{Labels: map[string]string{"httpcgi.enable": "true"}},
+		},
+	}, nil)
+	if err := idx.refresh(context.Background(), cli, "id1"); err != nil {
+		t.Error("refresh", err)
+	}
+	if len(idx.tags) != 3 || idx.tags["new:v1"].ID != "id1" || idx.tags["other:latest"].ID != "id2" ||
+		idx.tags["new:latest"].Labels["httpcgi.enable"] != "true" {
+		t.Error("tags", idx.tags)
+	}
+	cli.EXPECT().ImageInspect(gomock.Any(), "id1").Return(image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such image")))
+	if err := idx.refresh(context.Background(), cli, "id1"); err != nil {
+		t.Error("refresh deleted", err)
+	}
+	if len(idx.tags) != 1 {
+		t.Error("tags", idx.tags)
+	}
+	cli.EXPECT().ImageInspect(gomock.Any(), "id2").Return(image.InspectResponse{}, fmt.Errorf("error"))
+	if err := idx.refresh(context.Background(), cli, "id2"); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestImageIndexWatch(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	idx := newImageIndex()
+	msgs := make(chan events.Message)
+	errs := make(chan error)
+	cli.EXPECT().Events(gomock.Any(), gomock.Any()).Return(msgs, errs)
+	cli.EXPECT().ImageList(gomock.Any(), gomock.Any()).Return([]image.Summary{
+		{ID: "id1", RepoTags: []string{"base/a:latest"}},
+	}, nil)
+	cli.EXPECT().ImageInspect(gomock.Any(), "base/b:latest").Return(image.InspectResponse{
+		ID: "id2", RepoTags: []string{"base/b:latest"},
+	}, nil)
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := idx.sync(ctx, cli); err != nil {
+		t.Fatal("sync", err)
+	}
+	done := make(chan struct{})
+	go func() {
+		idx.watch(ctx, cli, time.Hour)
+		close(done)
+	}()
+	msgs <- events.Message{Type: events.ImageEventType, Action: events.ActionPull, Actor: events.Actor{ID: "base/b:latest"}}
+	// ignored
+	msgs <- events.Message{Type: events.ImageEventType, Action: events.ActionPush, Actor: events.Actor{ID: "id1"}}
+	cancel()
+	<-done
+	runner := DockerRunner{cli: cli, index: idx}
+	conf := SrvConfig{}
+	conf.BaseDir = "base/"
+	conf.Suffix = ":latest"
+	for _, p := range []string{"a", "b/info"} {
+		if name, _, err := runner.Exists(conf, p, context.Background()); err != nil {
+			t.Error("exists", p, name, err)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+//go:build docker
+
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types/mount"
+)
+
+const (
+	labelPrefix  = "httpcgi."
+	labelEnable  = labelPrefix + "enable"
+	labelWorkDir = labelPrefix + "workdir"
+	labelTimeout = labelPrefix + "timeout"
+	labelEnv     = labelPrefix + "env."
+	labelMounts  = labelPrefix + "mounts"
+	labelMemory  = labelPrefix + "memory"
+	labelUser    = labelPrefix + "user"
+)
+
+// imageSettings is CGI execution settings declared by image labels
+type imageSettings struct {
+	WorkDir string
+	Timeout time.Duration
+	Env     map[string]string
+	Mounts  []string
+	Memory  ByteSize
+	User    string
+}
+
+// labelEnabled returns whether the image can be run as CGI.
+// if required, image must have httpcgi.enable=true
+func labelEnabled(labels map[string]string, required bool) bool {
+	v, ok := labels[labelEnable]
+	if !ok {
+		return !required
+	}
+	enabled, err := strconv.ParseBool(v)
+	return err == nil && enabled
+}
+
+// parseImageLabels parses httpcgi.* labels
+func parseImageLabels(labels map[string]string) (imageSettings, error) {
+	res := imageSettings{Env: map[string]string{}}
+	for k, v := range labels {
+		if !strings.HasPrefix(k, labelPrefix) {
+			continue
+		}
+		switch {
+		case k == labelEnable:
+		case k == labelWorkDir:
+			res.WorkDir = v
+		case k == labelTimeout:
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return res, fmt.Errorf("invalid label %s: %w", k, err)
+			}
+			res.Timeout = d
+		case strings.HasPrefix(k, labelEnv):
+			res.Env[k[len(labelEnv):]] = v
+		case k == labelMounts:
+			// image must not reach host filesystem or volumes
+			res.Mounts = strings.Fields(v)
+			for _, m := range parseMounts(res.Mounts) {
+				if m.Type != mount.TypeTmpfs {
+					return res, fmt.Errorf("invalid label %s: only tmpfs is allowed: %s:%s", k, m.Source, m.Target)
+				}
+			}
+		case k == labelMemory:
+			if err := res.Memory.UnmarshalFlag(v); err != nil {
+				return res, fmt.Errorf("invalid label %s: %w", k, err)
+			}
+		case k == labelUser:
+			res.User = v
+		default:
+			slog.Warn("unknown label", "label", k)
+		}
+	}
+	return res, nil
+}
+
+// apply merges image settings into conf.
+// timeout and memory limit can only be lowered by the image, and user is used only if not configured
+func (s imageSettings) apply(conf SrvConfig) SrvConfig {
+	if s.WorkDir != "" {
+		conf.DockerWorkDir = s.WorkDir
+	}
+	if s.Timeout > 0 && (conf.Timeout == 0 || s.Timeout < conf.Timeout) {
+		conf.Timeout = s.Timeout
+	}
+	if s.Memory > 0 && (conf.DockerMemory == 0 || s.Memory < conf.DockerMemory) {
+		conf.DockerMemory = s.Memory
+	}
+	if s.User != "" && conf.DockerUser == "" {
+		conf.DockerUser = s.User
+	}
+	conf.DockerMounts = append(slices.Clip(conf.DockerMounts), s.Mounts...)
+	return conf
+}
@@ -0,0 +1,209 @@
+//go:build docker
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/golang/mock/gomock"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wtnb75/httpcgi/mock_client"
+)
+
+func TestLabelEnabled(t *testing.T) {
+	t.Parallel()
+	tests := []struct {
+		labels   map[string]string
+		required bool
+		expected bool
+	}{
+		{nil, false, true},
+		{nil, true, false},
+		{map[string]string{"httpcgi.enable": "true"}, true, true},
+		{map[string]string{"httpcgi.enable": "false"}, false, false},
+		{map[string]string{"httpcgi.enable": "yes"}, false, false},
+	}
+	for _, tt := range tests {
+		if res := labelEnabled(tt.labels, tt.required); res != tt.expected {
+			t.Error(tt.labels, tt.required, res)
+		}
+	}
+}
+
+func TestParseImageLabels(t *testing.T) {
+	t.Parallel()
+	settings, err := parseImageLabels(map[string]string{
+		"httpcgi.enable":   "true",
+		"httpcgi.workdir":  "/app",
+		"httpcgi.timeout":  "10s",
+		"httpcgi.env.FOO":  "bar",
+		"httpcgi.mounts":   "cache:/cache:tmpfs tmp:/work:tmpfs",
+		"httpcgi.memory":   "64m",
+		"httpcgi.user":     "nobody",
+		"org.example.name": "ignored",
+	})
+	if err != nil {
+		t.Error("parse", err)
+	}
+	if settings.WorkDir != "/app" || settings.Timeout != 10*time.Second || settings.Env["FOO"] != "bar" ||
+		len(settings.Mounts) != 2 || settings.Memory != 64*1024*1024 || settings.User != "nobody" {
+		t.Error("settings", settings)
+	}
+	for _, labels := range []map[string]string{
+		{"httpcgi.timeout": "10"},
+		{"httpcgi.memory": "lots"},
+		{"httpcgi.mounts": "/etc:/etc:ro"},
+		{"httpcgi.mounts": "data:/data:volume"},
+		{"httpcgi.mounts": "tmp:/work:tmpfs pipe:/pipe:npipe"},
+		{"httpcgi.mounts": "vol:/vol:cluster"},
+	} {
+		if _, err := parseImageLabels(labels); err == nil {
+			t.Error("no error", labels)
+		}
+	}
+}
+
+func TestImageSettingsApply(t *testing.T) {
+	t.Parallel()
+	conf := SrvConfig{}
+	conf.Timeout = 5 * time.Second
+	conf.DockerMemory = 256 * 1024 * 1024
+	conf.DockerMounts = make([]string, 1, 10)
+	conf.DockerMounts[0] = "a:/a:ro"
+	res := imageSettings{
+		WorkDir: "/app",
+		Timeout: time.Minute,
+		Memory:  64 * 1024 * 1024,
+		Mounts:  []string{"cache:/cache:tmpfs"},
+		User:    "nobody",
+	}.apply(conf)
+	// limits are only lowered
+	if res.Timeout != 5*time.Second || res.DockerMemory != 64*1024*1024 {
+		t.Error("limits", res.Timeout, res.DockerMemory)
+	}
+	if res.DockerWorkDir != "/app" || res.DockerUser != "nobody" {
+		t.Error("workdir/user", res.DockerWorkDir, res.DockerUser)
+	}
+	// backing array of conf is not shared
+	if !slices.Equal(res.DockerMounts, []string{"a:/a:ro", "cache:/cache:tmpfs"}) || conf.DockerMounts[:2][1] != "" {
+		t.Error("mounts", res.DockerMounts, conf.DockerMounts)
+	}
+	// configured user is not overridden
+	conf.DockerUser = "cgi"
+	if res := (imageSettings{User: "root"}).apply(conf); res.DockerUser != "cgi" {
+		t.Error("user", res.DockerUser)
+	}
+}
+
+func TestDockerRunLabels(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	runner := DockerRunner{cli: cli}
+	conf := SrvConfig{}
+	conf.DockerWorkDir = "/global"
+	envs := map[string]string{"SCRIPT_NAME": "/path1"}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{
+		Config: &dockerspec.DockerOCIImageConfig{
+			ImageConfig: ocispec.ImageConfig{Labels: map[string]string{
+				"httpcgi.workdir":         "/app",
+				"httpcgi.user":            "nobody",
+				"httpcgi.env.FOO":         "bar",
+				"httpcgi.env.SCRIPT_NAME": "/overridden",
+			}},
+		},
+	}, nil)
+	cres := container.CreateResponse{ID: "id123"}
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").DoAndReturn(
+		func(ctx context.Context, cconf *container.Config, hconf *container.HostConfig,
+			_ *network.NetworkingConfig, _ *ocispec.Platform, _ string) (container.CreateResponse, error) {
+			if cconf.WorkingDir != "/app" || cconf.User != "nobody" {
+				t.Error("config", cconf.WorkingDir, cconf.User)
+			}
+			if !slices.Contains(cconf.Env, "FOO=bar") || !slices.Contains(cconf.Env, "SCRIPT_NAME=/path1") {
+				t.Error("env", cconf.Env)
+			}
+			return cres, nil
+		})
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	ch_exit := make(chan container.WaitResponse, 1)
+	ch_err := make(chan error, 1)
+	cli.EXPECT().ContainerWait(gomock.Any(), "id123", container.WaitConditionNotRunning).Return(ch_exit, ch_err)
+	hr, _ := fakeAttach(0, "", "")
+	cli.EXPECT().ContainerAttach(gomock.Any(), "id123", gomock.Any()).Return(hr, nil)
+	ch_exit <- container.WaitResponse{}
+	err := runner.Run(conf, "path1", envs, stdin, stdout, stderr, context.Background())
+	if err != nil {
+		t.Error("err", err)
+	}
+	// env of the caller is not modified
+	if len(envs) != 1 {
+		t.Error("envs", envs)
+	}
+}
+
+func TestDockerRunIndexedLabels(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	index := newImageIndex()
+	index.tags["path1"] = indexEntry{ID: "sha256:1", Labels: map[string]string{
+		"httpcgi.user":    "root",
+		"httpcgi.env.FOO": "bar",
+	}}
+	runner := DockerRunner{cli: cli, index: index}
+	conf := SrvConfig{}
+	conf.DockerUser = "cgi"
+	// no ImageInspect: labels are read from the index
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").DoAndReturn(
+		func(ctx context.Context, cconf *container.Config, hconf *container.HostConfig,
+			_ *network.NetworkingConfig, _ *ocispec.Platform, _ string) (container.CreateResponse, error) {
+			if cconf.User != "cgi" || !slices.Contains(cconf.Env, "FOO=bar") {
+				t.Error("config", cconf.User, cconf.Env)
+			}
+			return container.CreateResponse{ID: "id123"}, nil
+		})
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	ch_exit := make(chan container.WaitResponse, 1)
+	cli.EXPECT().ContainerWait(gomock.Any(), "id123", container.WaitConditionNotRunning).Return(ch_exit, make(chan error, 1))
+	hr, _ := fakeAttach(0, "", "")
+	cli.EXPECT().ContainerAttach(gomock.Any(), "id123", gomock.Any()).Return(hr, nil)
+	ch_exit <- container.WaitResponse{}
+	err := runner.Run(conf, "path1", map[string]string{}, io.NopCloser(&bytes.Buffer{}), &bytes.Buffer{}, &bytes.Buffer{}, context.Background())
+	if err != nil {
+		t.Error("err", err)
+	}
+}
+
+func TestDockerRunBadLabels(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	runner := DockerRunner{cli: cli}
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{
+		Config: &dockerspec.DockerOCIImageConfig{
+			ImageConfig: ocispec.ImageConfig{Labels: map[string]string{"httpcgi.mounts": "/:/host"}},
+		},
+	}, nil)
+	err := runner.Run(SrvConfig{}, "path1", map[string]string{}, io.NopCloser(&bytes.Buffer{}), &bytes.Buffer{}, &bytes.Buffer{}, context.Background())
+	if err == nil {
+		t.Error("no error")
+	}
+}
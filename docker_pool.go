@@ -0,0 +1,326 @@
+//go:build docker
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+)
+
+// poolStartBackoff is time to run requests without the pool after the container failed to start
+const poolStartBackoff = 30 * time.Second
+
+// containerPool keeps long-lived containers per image and runs requests by exec
+type containerPool struct {
+	cli     client.APIClient
+	tracker *containerTracker
+	size    int      // containers per image
+	maxUses int      // recycle after this number of requests
+	idleCmd []string // keeps container running
+	mu      sync.Mutex
+	idle    map[string][]*pooledContainer // pool key -> idle containers
+	count   map[string]int                // pool key -> idle and busy containers
+	backoff time.Duration                 // do not start containers of the key after failure
+	failed  map[string]time.Time          // pool key -> time to retry start
+}
+
+type pooledContainer struct {
+	ID    string
+	Image string
+	key   string   // pool key
+	cmd   []string // entrypoint and cmd of the image
+	uses  int
+}
+
+// poolKey identifies containers which can run the request: same image, host config, user and workdir.
+// requests with other route config or labels do not share containers
+func poolKey(contConfig container.Config, hostConfig container.HostConfig) string {
+	data, err := json.Marshal(struct {
+		Host    container.HostConfig
+		User    string
+		WorkDir string
+	}{hostConfig, contConfig.User, contConfig.WorkingDir})
+	if err != nil {
+		// not expected. do not share the container
+		return contConfig.Image + "@" + rand.Text()
+	}
+	sum := sha256.Sum256(data)
+	return contConfig.Image + "@" + hex.EncodeToString(sum[:8])
+}
+
+func newContainerPool(cli client.APIClient, tracker *containerTracker, size int, maxUses int, idleCmd []string) *containerPool {
+	return &containerPool{
+		cli:     cli,
+		tracker: tracker,
+		size:    size,
+		maxUses: maxUses,
+		idleCmd: idleCmd,
+		idle:    map[string][]*pooledContainer{},
+		count:   map[string]int{},
+		backoff: poolStartBackoff,
+		failed:  map[string]time.Time{},
+	}
+}
+
+// imageCommand returns command to exec from entrypoint and cmd of the image
+func imageCommand(insp image.InspectResponse) []string {
+	if insp.Config == nil {
+		return nil
+	}
+	return append(slices.Clip(insp.Config.Entrypoint), insp.Config.Cmd...)
+}
+
+// acquire returns idle container, or starts new one.
+// returns nil if the pool of the image is full or the container can not be started.
+// after start failure, returns nil without starting until the backoff expires
+func (pool *containerPool) acquire(ctx context.Context, contConfig container.Config, hostConfig container.HostConfig) *pooledContainer {
+	name := poolKey(contConfig, hostConfig)
+	pool.mu.Lock()
+	if cs := pool.idle[name]; len(cs) != 0 {
+		c := cs[len(cs)-1]
+		pool.idle[name] = cs[:len(cs)-1]
+		pool.mu.Unlock()
+		return c
+	}
+	if pool.count[name] >= pool.size {
+		pool.mu.Unlock()
+		slog.Debug("pool full", "image", name)
+		return nil
+	}
+	if retry, ok := pool.failed[name]; ok && time.Now().Before(retry) {
+		pool.mu.Unlock()
+		slog.Debug("pool backoff", "image", name, "retry", retry)
+		return nil
+	}
+	pool.count[name]++
+	pool.mu.Unlock()
+	c, err := pool.start(ctx, contConfig, hostConfig)
+	pool.mu.Lock()
+	defer pool.mu.Unlock()
+	if err != nil {
+		slog.Error("pool start", "image", contConfig.Image, "key", name, "error", err)
+		pool.count[name]--
+		if ctx.Err() == nil {
+			// cancelled request is not a failure of the image
+			pool.failed[name] = time.Now().Add(pool.backoff)
+		}
+		return nil
+	}
+	delete(pool.failed, name)
+	return c
+}
+
+// start creates and starts new container of the pool
+func (pool *containerPool) start(ctx context.Context, contConfig container.Config, hostConfig container.HostConfig) (*pooledContainer, error) {
+	insp, err := pool.cli.ImageInspect(ctx, contConfig.Image)
+	if err != nil {
+		return nil, err
+	}
+	cfg := container.Config{
+		Image:      contConfig.Image,
+		User:       contConfig.User,
+		WorkingDir: contConfig.WorkingDir,
+		Entrypoint: pool.idleCmd,
+		Cmd:        []string{},
+		Labels:     pool.tracker.poolLabels(contConfig.Image),
+	}
+	cres, err := pool.cli.ContainerCreate(ctx, &cfg, &hostConfig, nil, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	pool.tracker.add(cres.ID)
+	if err := pool.cli.ContainerStart(ctx, cres.ID, container.StartOptions{}); err != nil {
+		pool.remove(context.WithoutCancel(ctx), cres.ID)
+		return nil, err
+	}
+	slog.Info("pool started", "image", contConfig.Image, "id", cres.ID)
+	return &pooledContainer{ID: cres.ID, Image: contConfig.Image, key: poolKey(contConfig, hostConfig), cmd: imageCommand(insp)}, nil
+}
+
+// release returns container to the pool. unhealthy or worn-out container is removed
+func (pool *containerPool) release(ctx context.Context, c *pooledContainer, healthy bool) {
+	c.uses++
+	if !healthy || (pool.maxUses > 0 && c.uses >= pool.maxUses) {
+		pool.discard(ctx, c)
+		return
+	}
+	pool.mu.Lock()
+	pool.idle[c.key] = append(pool.idle[c.key], c)
+	pool.mu.Unlock()
+}
+
+// discard removes container from the pool
+func (pool *containerPool) discard(ctx context.Context, c *pooledContainer) {
+	slog.Info("pool recycle", "image", c.Image, "id", c.ID, "uses", c.uses)
+	pool.mu.Lock()
+	pool.count[c.key]--
+	pool.mu.Unlock()
+	go pool.remove(context.WithoutCancel(ctx), c.ID)
+}
+
+func (pool *containerPool) remove(ctx context.Context, id string) {
+	if err := pool.cli.ContainerRemove(ctx, id, container.RemoveOptions{Force: true}); err != nil {
+		slog.Error("pool remove", "id", id, "error", err)
+	}
+	pool.tracker.remove(id)
+}
+
+// command runs helper command in the container and waits for it
+func (pool *containerPool) command(ctx context.Context, c *pooledContainer, user string, cmd ...string) error {
+	ex, err := pool.cli.ContainerExecCreate(ctx, c.ID, container.ExecOptions{
+		User:         user,
+		Cmd:          cmd,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		return err
+	}
+	hr, err := pool.cli.ContainerExecAttach(ctx, ex.ID, container.ExecAttachOptions{})
+	if err != nil {
+		return err
+	}
+	defer hr.Close()
+	var out bytes.Buffer
+	if _, err := stdcopy.StdCopy(&out, &out, hr.Reader); err != nil {
+		return err
+	}
+	res, err := pool.cli.ContainerExecInspect(ctx, ex.ID)
+	if err != nil {
+		return err
+	}
+	if res.ExitCode != 0 {
+		return fmt.Errorf("%s: exit %d: %s", strings.Join(cmd, " "), res.ExitCode, strings.TrimSpace(out.String()))
+	}
+	return nil
+}
+
+// exec runs command of the image in pooled container with environment and stdin of the request.
+// if TMPDIR is /tmp (per-request scratch), the exec gets private TMPDIR under it, removed after the exec
+func (pool *containerPool) exec(ctx context.Context, c *pooledContainer, contConfig container.Config,
+	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer) error {
+	if len(c.cmd) == 0 {
+		pool.release(ctx, c, true)
+		return fmt.Errorf("no command in image: %s", c.Image)
+	}
+	env := contConfig.Env
+	cleanup := func() bool { return true }
+	if i := slices.Index(env, "TMPDIR=/tmp"); i >= 0 {
+		tmpdir := "/tmp/httpcgi-" + strings.ToLower(rand.Text())
+		if err := pool.command(ctx, c, contConfig.User, "mkdir", "-m", "700", tmpdir); err != nil {
+			slog.Error("mkdir tmpdir", "id", c.ID, "error", err)
+			pool.release(ctx, c, false)
+			return err
+		}
+		env = slices.Clone(env)
+		env[i] = "TMPDIR=" + tmpdir
+		cleanup = func() bool {
+			if err := pool.command(context.WithoutCancel(ctx), c, contConfig.User, "rm", "-rf", tmpdir); err != nil {
+				// files of the request may remain. recycle the container
+				slog.Error("rm tmpdir", "id", c.ID, "error", err)
+				return false
+			}
+			return true
+		}
+	}
+	ex, err := pool.cli.ContainerExecCreate(ctx, c.ID, container.ExecOptions{
+		User:         contConfig.User,
+		WorkingDir:   contConfig.WorkingDir,
+		Env:          env,
+		Cmd:          c.cmd,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+	})
+	if err != nil {
+		slog.Error("execCreate", "id", c.ID, "error", err)
+		pool.release(ctx, c, false)
+		return err
+	}
+	hr, err := pool.cli.ContainerExecAttach(ctx, ex.ID, container.ExecAttachOptions{})
+	if err != nil {
+		slog.Error("execAttach", "id", c.ID, "error", err)
+		pool.release(ctx, c, false)
+		return err
+	}
+	defer hr.Close()
+	if lw, ok := stderr.(*logWriter); ok {
+		lw = lw.With("container", c.ID)
+		defer lw.Close()
+		stderr = lw
+	}
+	outDone := attachStreams(hr, stdin, stdout, stderr)
+	select {
+	case err := <-outDone:
+		if err != nil {
+			slog.Error("stdcopy", "error", err)
+			pool.release(ctx, c, false)
+			return err
+		}
+	case <-ctx.Done():
+		// exec can not be killed. recycle the container
+		slog.Warn("cancelled", "id", c.ID, "error", context.Cause(ctx))
+		pool.release(ctx, c, false)
+		return context.Cause(ctx)
+	}
+	res, err := pool.cli.ContainerExecInspect(ctx, ex.ID)
+	if err != nil {
+		slog.Error("execInspect", "id", c.ID, "error", err)
+		pool.release(ctx, c, false)
+		return err
+	}
+	slog.Debug("exec done", "id", c.ID, "exit", res.ExitCode)
+	pool.release(ctx, c, cleanup())
+	return exitStatus(ctx, c.Image, c.ID, res.ExitCode, false)
+}
+
+// check removes idle containers which are not running
+func (pool *containerPool) check(ctx context.Context) {
+	pool.mu.Lock()
+	idle := pool.idle
+	pool.idle = map[string][]*pooledContainer{}
+	pool.mu.Unlock()
+	for _, cs := range idle {
+		for _, c := range cs {
+			insp, err := pool.cli.ContainerInspect(ctx, c.ID)
+			if err != nil || insp.State == nil || !insp.State.Running {
+				slog.Warn("pool unhealthy", "image", c.Image, "id", c.ID, "error", err)
+				pool.discard(ctx, c)
+				continue
+			}
+			pool.mu.Lock()
+			pool.idle[c.key] = append(pool.idle[c.key], c)
+			pool.mu.Unlock()
+		}
+	}
+}
+
+// watch checks idle containers periodically
+func (pool *containerPool) watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			pool.check(ctx)
+		}
+	}
+}
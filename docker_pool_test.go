@@ -0,0 +1,279 @@
+//go:build docker
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/golang/mock/gomock"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wtnb75/httpcgi/mock_client"
+)
+
+func TestDockerRunPool(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	pool := newContainerPool(cli, nil, 1, 2, []string{"sleep", "infinity"})
+	index := newImageIndex()
+	index.tags["path1"] = indexEntry{ID: "sha256:1"}
+	runner := DockerRunner{cli: cli, pool: pool, index: index}
+	conf := SrvConfig{}
+	insp := image.InspectResponse{
+		Config: &dockerspec.DockerOCIImageConfig{
+			ImageConfig: ocispec.ImageConfig{Entrypoint: []string{"/cgi"}, Cmd: []string{"arg"}},
+		},
+	}
+	// labels are in the index. image is inspected only when the container is started
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(insp, nil).Times(1)
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").DoAndReturn(
+		func(ctx context.Context, cconf *container.Config, hconf *container.HostConfig,
+			_ *network.NetworkingConfig, _ *ocispec.Platform, _ string) (container.CreateResponse, error) {
+			if !slices.Equal(cconf.Entrypoint, []string{"sleep", "infinity"}) || len(cconf.Env) != 0 {
+				t.Error("config", cconf.Entrypoint, cconf.Env)
+			}
+			return container.CreateResponse{ID: "id123"}, nil
+		})
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	cli.EXPECT().ContainerExecCreate(gomock.Any(), "id123", gomock.Any()).DoAndReturn(
+		func(ctx context.Context, id string, opts container.ExecOptions) (container.ExecCreateResponse, error) {
+			if !slices.Equal(opts.Cmd, []string{"/cgi", "arg"}) || !slices.Contains(opts.Env, "KEY=value") {
+				t.Error("exec", opts.Cmd, opts.Env)
+			}
+			return container.ExecCreateResponse{ID: "exec1"}, nil
+		}).Times(2)
+	cli.EXPECT().ContainerExecAttach(gomock.Any(), "exec1", gomock.Any()).DoAndReturn(
+		func(context.Context, string, container.ExecAttachOptions) (types.HijackedResponse, error) {
+			hr, _ := fakeAttach(5, "output", "")
+			return hr, nil
+		}).Times(2)
+	cli.EXPECT().ContainerExecInspect(gomock.Any(), "exec1").Return(container.ExecInspect{}, nil).Times(2)
+	removed := make(chan struct{})
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).DoAndReturn(
+		func(context.Context, string, container.RemoveOptions) error {
+			close(removed)
+			return nil
+		})
+	for i := range 2 {
+		stdout := &bytes.Buffer{}
+		stdin := io.NopCloser(bytes.NewBufferString("input"))
+		err := runner.Run(conf, "path1", map[string]string{"KEY": "value"}, stdin, stdout, &bytes.Buffer{}, context.Background())
+		if err != nil {
+			t.Error("err", i, err)
+		}
+		if stdout.String() != "output" {
+			t.Error("stdout", i, stdout.String())
+		}
+	}
+	// recycled after max uses
+	<-removed
+	for key, n := range pool.count {
+		if n != 0 || len(pool.idle[key]) != 0 {
+			t.Error("pool", pool.count, pool.idle)
+		}
+	}
+}
+
+func TestDockerRunPoolCancel(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	pool := newContainerPool(cli, nil, 1, 0, []string{"sleep", "infinity"})
+	key := poolKey(container.Config{Image: "path1"}, container.HostConfig{})
+	c := &pooledContainer{ID: "id123", Image: "path1", key: key, cmd: []string{"/cgi"}}
+	pool.idle[key] = []*pooledContainer{c}
+	pool.count[key] = 1
+	ctx, cancel := context.WithCancel(context.Background())
+	cli.EXPECT().ContainerExecCreate(gomock.Any(), "id123", gomock.Any()).Return(container.ExecCreateResponse{ID: "exec1"}, nil)
+	cli.EXPECT().ContainerExecAttach(gomock.Any(), "exec1", gomock.Any()).DoAndReturn(
+		func(context.Context, string, container.ExecAttachOptions) (types.HijackedResponse, error) {
+			// never finishes
+			hr, _ := fakeAttach(100, "", "")
+			cancel()
+			return hr, nil
+		})
+	removed := make(chan struct{})
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).DoAndReturn(
+		func(ctx context.Context, _ string, _ container.RemoveOptions) error {
+			if ctx.Err() != nil {
+				t.Error("remove with cancelled context")
+			}
+			close(removed)
+			return nil
+		})
+	got := pool.acquire(ctx, container.Config{Image: "path1"}, container.HostConfig{})
+	if got != c {
+		t.Error("acquire", got)
+	}
+	err := pool.exec(ctx, got, container.Config{}, io.NopCloser(&bytes.Buffer{}), &bytes.Buffer{}, &bytes.Buffer{})
+	if !errors.Is(err, context.Canceled) {
+		t.Error("err", err)
+	}
+	<-removed
+	if pool.count[key] != 0 {
+		t.Error("count", pool.count)
+	}
+}
+
+func TestContainerPoolFull(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	pool := newContainerPool(cli, nil, 1, 0, []string{"sleep", "infinity"})
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{}, nil).Times(2)
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").Return(container.CreateResponse{ID: "id123"}, nil)
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").Return(container.CreateResponse{ID: "id456"}, nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id456", gomock.Any()).Return(nil)
+	if c := pool.acquire(context.Background(), container.Config{Image: "path1"}, container.HostConfig{}); c == nil || c.ID != "id123" {
+		t.Error("acquire", c)
+	}
+	if c := pool.acquire(context.Background(), container.Config{Image: "path1"}, container.HostConfig{}); c != nil {
+		t.Error("full", c)
+	}
+	// other user does not share the container
+	if c := pool.acquire(context.Background(), container.Config{Image: "path1", User: "nobody"}, container.HostConfig{}); c == nil || c.ID != "id456" {
+		t.Error("acquire user", c)
+	}
+}
+
+func TestContainerPoolBackoff(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	pool := newContainerPool(cli, nil, 1, 0, []string{"sleep", "infinity"})
+	insp := image.InspectResponse{}
+	gomock.InOrder(
+		cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(insp, errors.New("broken")),
+		cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(insp, nil),
+	)
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").Return(container.CreateResponse{ID: "id123"}, nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	conf := container.Config{Image: "path1"}
+	for i := range 2 {
+		// second one does not start the container
+		if c := pool.acquire(context.Background(), conf, container.HostConfig{}); c != nil {
+			t.Error("failed", i, c)
+		}
+	}
+	key := poolKey(conf, container.HostConfig{})
+	pool.mu.Lock()
+	pool.failed[key] = time.Now()
+	pool.mu.Unlock()
+	if c := pool.acquire(context.Background(), conf, container.HostConfig{}); c == nil || c.ID != "id123" {
+		t.Error("retry", c)
+	}
+	if _, ok := pool.failed[key]; ok || pool.count[key] != 1 {
+		t.Error("state", pool.failed, pool.count)
+	}
+}
+
+func TestPoolKey(t *testing.T) {
+	t.Parallel()
+	base := poolKey(container.Config{Image: "path1"}, container.HostConfig{})
+	if base != poolKey(container.Config{Image: "path1", Env: []string{"KEY=value"}}, container.HostConfig{}) {
+		t.Error("env changes key")
+	}
+	others := []string{
+		poolKey(container.Config{Image: "path2"}, container.HostConfig{}),
+		poolKey(container.Config{Image: "path1", User: "nobody"}, container.HostConfig{}),
+		poolKey(container.Config{Image: "path1", WorkingDir: "/work"}, container.HostConfig{}),
+		poolKey(container.Config{Image: "path1"}, container.HostConfig{Binds: []string{"/data:/data"}}),
+	}
+	for i, k := range others {
+		if k == base {
+			t.Error("same key", i, k)
+		}
+	}
+}
+
+func TestContainerPoolTmpdir(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	pool := newContainerPool(cli, nil, 1, 0, []string{"sleep", "infinity"})
+	key := poolKey(container.Config{Image: "path1"}, container.HostConfig{})
+	c := &pooledContainer{ID: "id123", Image: "path1", key: key, cmd: []string{"/cgi"}}
+	pool.count[key] = 1
+	tmpdir := ""
+	cli.EXPECT().ContainerExecCreate(gomock.Any(), "id123", gomock.Any()).DoAndReturn(
+		func(ctx context.Context, id string, opts container.ExecOptions) (container.ExecCreateResponse, error) {
+			switch opts.Cmd[0] {
+			case "mkdir":
+				tmpdir = opts.Cmd[len(opts.Cmd)-1]
+				if !strings.HasPrefix(tmpdir, "/tmp/httpcgi-") || opts.User != "nobody" {
+					t.Error("mkdir", opts.Cmd, opts.User)
+				}
+			case "/cgi":
+				if !slices.Contains(opts.Env, "TMPDIR="+tmpdir) {
+					t.Error("env", opts.Env)
+				}
+			case "rm":
+				if !slices.Equal(opts.Cmd, []string{"rm", "-rf", tmpdir}) {
+					t.Error("rm", opts.Cmd)
+				}
+			}
+			return container.ExecCreateResponse{ID: opts.Cmd[0]}, nil
+		}).Times(3)
+	cli.EXPECT().ContainerExecAttach(gomock.Any(), gomock.Any(), gomock.Any()).DoAndReturn(
+		func(context.Context, string, container.ExecAttachOptions) (types.HijackedResponse, error) {
+			hr, _ := fakeAttach(0, "", "")
+			return hr, nil
+		}).Times(3)
+	cli.EXPECT().ContainerExecInspect(gomock.Any(), gomock.Any()).Return(container.ExecInspect{}, nil).Times(3)
+	contConfig := container.Config{User: "nobody", Env: []string{"TMPDIR=/tmp"}}
+	err := pool.exec(context.Background(), c, contConfig, io.NopCloser(&bytes.Buffer{}), &bytes.Buffer{}, &bytes.Buffer{})
+	if err != nil {
+		t.Error("err", err)
+	}
+	if contConfig.Env[0] != "TMPDIR=/tmp" {
+		t.Error("env modified", contConfig.Env)
+	}
+	if len(pool.idle[key]) != 1 {
+		t.Error("released", pool.idle)
+	}
+}
+
+func TestContainerPoolCheck(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	pool := newContainerPool(cli, nil, 2, 0, []string{"sleep", "infinity"})
+	pool.idle["key1"] = []*pooledContainer{{ID: "alive", Image: "path1", key: "key1"}, {ID: "dead", Image: "path1", key: "key1"}}
+	pool.count["key1"] = 2
+	cli.EXPECT().ContainerInspect(gomock.Any(), "alive").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{State: &container.State{Running: true}},
+	}, nil)
+	cli.EXPECT().ContainerInspect(gomock.Any(), "dead").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{State: &container.State{Running: false}},
+	}, nil)
+	removed := make(chan struct{})
+	cli.EXPECT().ContainerRemove(gomock.Any(), "dead", gomock.Any()).DoAndReturn(
+		func(context.Context, string, container.RemoveOptions) error {
+			close(removed)
+			return nil
+		})
+	pool.check(context.Background())
+	<-removed
+	if pool.count["key1"] != 1 || len(pool.idle["key1"]) != 1 || pool.idle["key1"][0].ID != "alive" {
+		t.Error("pool", pool.count, pool.idle)
+	}
+}
@@ -0,0 +1,184 @@
+//go:build docker
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	pullMissTTL  = 30 * time.Second // failed pull is not retried for this time
+	pullMaxDepth = 3                // path prefixes deeper than this are not pulled
+)
+
+// imagePuller pulls images on demand. concurrent pulls of the same image are shared
+type imagePuller struct {
+	cli     client.APIClient
+	index   *imageIndex
+	group   singleflight.Group
+	mu      sync.Mutex
+	missing map[string]time.Time // ref -> expiry of failed pull
+}
+
+func newImagePuller(cli client.APIClient, index *imageIndex) *imagePuller {
+	return &imagePuller{cli: cli, index: index, missing: map[string]time.Time{}}
+}
+
+// missed returns error if pull of the ref failed recently
+func (p *imagePuller) missed(ref string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if exp, ok := p.missing[ref]; ok && time.Now().Before(exp) {
+		return fmt.Errorf("image pull failed recently: %s", ref)
+	}
+	return nil
+}
+
+// miss records failed pull of the ref, and forgets expired ones
+func (p *imagePuller) miss(ref string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := time.Now()
+	for k, exp := range p.missing {
+		if now.After(exp) {
+			delete(p.missing, k)
+		}
+	}
+	p.missing[ref] = now.Add(pullMissTTL)
+}
+
+// pullAllowed checks the reference by allowlist.
+// pattern ending with "/" matches registry or repository prefix, others are matched by path.Match
+func pullAllowed(named reference.Named, allow []string) bool {
+	name := named.Name()
+	for _, pat := range allow {
+		if strings.HasSuffix(pat, "/") {
+			if strings.HasPrefix(name, pat) {
+				return true
+			}
+		} else if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// checkPull validates the reference for pulling
+func checkPull(conf SrvConfig, ref string) error {
+	named, err := reference.ParseNormalizedNamed(ref)
+	if err != nil {
+		return fmt.Errorf("invalid image reference %s: %w", ref, err)
+	}
+	if !pullAllowed(named, conf.DockerPullAllow) {
+		return fmt.Errorf("image not allowed to pull: %s", named)
+	}
+	if _, ok := named.(reference.Digested); conf.DockerPullDigest && !ok {
+		return fmt.Errorf("image not pinned by digest: %s", named)
+	}
+	return nil
+}
+
+// ensure makes the image exist locally, pulling it if needed
+func (p *imagePuller) ensure(conf SrvConfig, ref string, ctx context.Context) error {
+	if err := checkPull(conf, ref); err != nil {
+		return err
+	}
+	if err := p.missed(ref); err != nil {
+		return err
+	}
+	insp, err := p.cli.ImageInspect(ctx, ref)
+	if err != nil {
+		if !client.IsErrNotFound(err) {
+			return err
+		}
+		ch := p.group.DoChan(ref, func() (any, error) {
+			// shared by requests. not cancelled by one of them
+			pctx := context.WithoutCancel(ctx)
+			if conf.DockerPullTimeout > 0 {
+				var cancel context.CancelFunc
+				pctx, cancel = context.WithTimeoutCause(pctx, conf.DockerPullTimeout,
+					fmt.Errorf("%w pulling %s", ErrTimeout, ref))
+				defer cancel()
+			}
+			err := p.pull(pctx, ref)
+			if err != nil {
+				p.miss(ref)
+			}
+			return nil, err
+		})
+		select {
+		case res := <-ch:
+			if res.Err != nil {
+				return res.Err
+			}
+		case <-ctx.Done():
+			return context.Cause(ctx)
+		}
+		if insp, err = p.cli.ImageInspect(ctx, ref); err != nil {
+			return err
+		}
+	}
+	if insp.Config != nil && !labelEnabled(insp.Config.Labels, conf.DockerLabel) {
+		return fmt.Errorf("image not enabled: %s", ref)
+	}
+	return nil
+}
+
+// resolve finds image of path by pulling, as imageIndex.resolve does. longest prefix which can be pulled wins.
+// prefixes deeper than pullMaxDepth are skipped, to limit pulls by a request
+func (p *imagePuller) resolve(conf SrvConfig, urlpath string, ctx context.Context) (string, string, error) {
+	var errs []error
+	for name, pathinfo := range pathPrefixes(urlpath) {
+		if strings.Count(strings.Trim(name, "/"), "/") >= pullMaxDepth {
+			continue
+		}
+		ref := conf.BaseDir + name + conf.Suffix
+		err := p.ensure(conf, ref, ctx)
+		if err == nil {
+			return ref, pathinfo, nil
+		}
+		if ctx.Err() != nil {
+			return "", "", err
+		}
+		errs = append(errs, err)
+	}
+	return "", "", errors.Join(errs...)
+}
+
+func (p *imagePuller) pull(ctx context.Context, ref string) error {
+	slog.Info("pull", "image", ref)
+	rc, err := p.cli.ImagePull(ctx, ref, image.PullOptions{})
+	if err != nil {
+		slog.Error("imagePull", "image", ref, "error", err)
+		return err
+	}
+	defer rc.Close()
+	if err := jsonmessage.DisplayJSONMessagesStream(rc, io.Discard, 0, false, nil); err != nil {
+		slog.Error("imagePull", "image", ref, "error", err)
+		if ctx.Err() != nil {
+			return context.Cause(ctx)
+		}
+		return err
+	}
+	slog.Info("pulled", "image", ref)
+	if p.index != nil {
+		if err := p.index.refresh(ctx, p.cli, ref); err != nil {
+			slog.Error("image index refresh", "image", ref, "error", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,217 @@
+//go:build docker
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/golang/mock/gomock"
+	dockerspec "github.com/moby/docker-image-spec/specs-go/v1"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/wtnb75/httpcgi/mock_client"
+)
+
+const testDigest = "@sha256:0123456789012345678901234567890123456789012345678901234567890123"
+
+func TestCheckPull(t *testing.T) {
+	t.Parallel()
+	conf := SrvConfig{}
+	conf.DockerPullAllow = []string{"ghcr.io/wtnb75/", "docker.io/library/alpine", "example.com/cgi-*"}
+	tests := []struct {
+		ref    string
+		digest bool
+		ok     bool
+	}{
+		{"alpine", false, true},
+		{"alpine:3", false, true},
+		{"docker.io/library/alpine:latest", false, true},
+		{"busybox", false, false},
+		{"ghcr.io/wtnb75/httpcgi:latest", false, true},
+		{"ghcr.io/wtnb75/sub/image", false, true},
+		{"ghcr.io/other/httpcgi", false, false},
+		{"example.com/cgi-hello", false, true},
+		{"example.com/cgi-hello/sub", false, false},
+		{"alpine:3", true, false},
+		{"alpine" + testDigest, true, true},
+		{"Invalid Ref", false, false},
+	}
+	for _, tt := range tests {
+		conf.DockerPullDigest = tt.digest
+		if err := checkPull(conf, tt.ref); (err == nil) != tt.ok {
+			t.Error(tt.ref, tt.digest, err)
+		}
+	}
+}
+
+func TestImagePullerShared(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	puller := newImagePuller(cli, nil)
+	conf := SrvConfig{}
+	conf.DockerPullAllow = []string{"docker.io/library/"}
+	conf.DockerPullTimeout = time.Minute
+	var inspected sync.WaitGroup
+	inspected.Add(2)
+	release := make(chan struct{})
+	cli.EXPECT().ImageInspect(gomock.Any(), "alpine:3").DoAndReturn(
+		func(context.Context, string, ...client.ImageInspectOption) (image.InspectResponse, error) {
+			inspected.Done()
+			return image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such image"))
+		}).Times(2)
+	cli.EXPECT().ImagePull(gomock.Any(), "alpine:3", gomock.Any()).DoAndReturn(
+		func(context.Context, string, image.PullOptions) (io.ReadCloser, error) {
+			<-release
+			return io.NopCloser(strings.NewReader(`{"status":"Pulling from library/alpine"}` + "\n")), nil
+		})
+	cli.EXPECT().ImageInspect(gomock.Any(), "alpine:3").Return(image.InspectResponse{}, nil).Times(2)
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Go(func() {
+			if err := puller.ensure(conf, "alpine:3", context.Background()); err != nil {
+				t.Error("ensure", err)
+			}
+		})
+	}
+	inspected.Wait()
+	// wait for both requests joining the pull
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+}
+
+func TestImagePullerError(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	puller := newImagePuller(cli, nil)
+	conf := SrvConfig{}
+	conf.DockerPullAllow = []string{"docker.io/library/"}
+	cli.EXPECT().ImageInspect(gomock.Any(), "alpine:3").Return(image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such image")))
+	cli.EXPECT().ImagePull(gomock.Any(), "alpine:3", gomock.Any()).Return(
+		io.NopCloser(strings.NewReader(`{"errorDetail":{"message":"denied"},"error":"denied"}`+"\n")), nil)
+	if err := puller.ensure(conf, "alpine:3", context.Background()); err == nil || !strings.Contains(err.Error(), "denied") {
+		t.Error("error", err)
+	}
+	// not allowed: no API call
+	if err := puller.ensure(conf, "ghcr.io/wtnb75/httpcgi", context.Background()); err == nil {
+		t.Error("not allowed")
+	}
+}
+
+func TestDockerExistsPull(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	idx := newImageIndex()
+	runner := DockerRunner{cli: cli, index: idx, puller: newImagePuller(cli, idx)}
+	conf := SrvConfig{}
+	conf.BaseDir = "ghcr.io/wtnb75/"
+	conf.Suffix = ":latest"
+	conf.DockerPullAllow = []string{"ghcr.io/wtnb75/"}
+	conf.DockerLabel = true
+	enabled := image.InspectResponse{
+		ID:       "id1",
+		RepoTags: []string{"ghcr.io/wtnb75/hello:latest"},
+		Config: &dockerspec.DockerOCIImageConfig{
+			ImageConfig: ocispec.ImageConfig{Labels: map[string]string{"httpcgi.enable": "true"}},
+		},
+	}
+	gomock.InOrder(
+		cli.EXPECT().ImageInspect(gomock.Any(), "ghcr.io/wtnb75/hello:latest").Return(image.InspectResponse{}, errdefs.NotFound(fmt.Errorf("no such image"))),
+		cli.EXPECT().ImagePull(gomock.Any(), "ghcr.io/wtnb75/hello:latest", gomock.Any()).Return(io.NopCloser(strings.NewReader("")), nil),
+		cli.EXPECT().ImageInspect(gomock.Any(), "ghcr.io/wtnb75/hello:latest").Return(enabled, nil).Times(2),
+		// not labeled
+		cli.EXPECT().ImageInspect(gomock.Any(), "ghcr.io/wtnb75/other:latest").Return(image.InspectResponse{
+			Config: &dockerspec.DockerOCIImageConfig{},
+		}, nil),
+	)
+	name, pathinfo, err := runner.Exists(conf, "hello", context.Background())
+	if name != "ghcr.io/wtnb75/hello:latest" || pathinfo != "" || err != nil {
+		t.Error("pulled", name, pathinfo, err)
+	}
+	// index is refreshed after pull
+	name, pathinfo, err = runner.Exists(conf, "hello/info", context.Background())
+	if name != "ghcr.io/wtnb75/hello:latest" || pathinfo != "/info" || err != nil {
+		t.Error("indexed", name, pathinfo, err)
+	}
+	if _, _, err := runner.Exists(conf, "other", context.Background()); err == nil {
+		t.Error("not labeled")
+	}
+}
+
+func TestDockerExistsPullPathInfo(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	runner := DockerRunner{cli: cli, index: newImageIndex(), puller: newImagePuller(cli, nil)}
+	conf := SrvConfig{}
+	conf.BaseDir = "ghcr.io/wtnb75/"
+	conf.Suffix = ":latest"
+	conf.DockerPullAllow = []string{"ghcr.io/wtnb75/"}
+	notFound := errdefs.NotFound(fmt.Errorf("no such image"))
+	gomock.InOrder(
+		// longest prefix first
+		cli.EXPECT().ImageInspect(gomock.Any(), "ghcr.io/wtnb75/hello/path/info:latest").Return(image.InspectResponse{}, notFound),
+		cli.EXPECT().ImagePull(gomock.Any(), "ghcr.io/wtnb75/hello/path/info:latest", gomock.Any()).Return(nil, notFound),
+		cli.EXPECT().ImageInspect(gomock.Any(), "ghcr.io/wtnb75/hello/path:latest").Return(image.InspectResponse{}, notFound),
+		cli.EXPECT().ImagePull(gomock.Any(), "ghcr.io/wtnb75/hello/path:latest", gomock.Any()).Return(nil, notFound),
+		cli.EXPECT().ImageInspect(gomock.Any(), "ghcr.io/wtnb75/hello:latest").Return(image.InspectResponse{}, notFound),
+		cli.EXPECT().ImagePull(gomock.Any(), "ghcr.io/wtnb75/hello:latest", gomock.Any()).Return(io.NopCloser(strings.NewReader("")), nil),
+		cli.EXPECT().ImageInspect(gomock.Any(), "ghcr.io/wtnb75/hello:latest").Return(image.InspectResponse{}, nil),
+	)
+	name, pathinfo, err := runner.Exists(conf, "hello/path/info", context.Background())
+	if name != "ghcr.io/wtnb75/hello:latest" || pathinfo != "/path/info" || err != nil {
+		t.Error("pulled", name, pathinfo, err)
+	}
+}
+
+func TestImagePullerMissing(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	puller := newImagePuller(cli, nil)
+	conf := SrvConfig{}
+	conf.BaseDir = "ghcr.io/wtnb75/"
+	conf.Suffix = ":latest"
+	conf.DockerPullAllow = []string{"ghcr.io/wtnb75/"}
+	notFound := errdefs.NotFound(fmt.Errorf("no such image"))
+	// too deep prefix is not pulled
+	for _, ref := range []string{"ghcr.io/wtnb75/a/b/c:latest", "ghcr.io/wtnb75/a/b:latest", "ghcr.io/wtnb75/a:latest"} {
+		cli.EXPECT().ImageInspect(gomock.Any(), ref).Return(image.InspectResponse{}, notFound)
+		cli.EXPECT().ImagePull(gomock.Any(), ref, gomock.Any()).Return(nil, notFound)
+	}
+	if name, _, err := puller.resolve(conf, "a/b/c/d", context.Background()); err == nil {
+		t.Error("pulled", name)
+	}
+	// failed pull is cached: no API call
+	if name, _, err := puller.resolve(conf, "a/b/c/d", context.Background()); err == nil {
+		t.Error("pulled", name)
+	}
+	puller.mu.Lock()
+	for ref := range puller.missing {
+		puller.missing[ref] = time.Now()
+	}
+	puller.mu.Unlock()
+	// expired
+	cli.EXPECT().ImageInspect(gomock.Any(), "ghcr.io/wtnb75/a:latest").Return(image.InspectResponse{}, notFound)
+	cli.EXPECT().ImagePull(gomock.Any(), "ghcr.io/wtnb75/a:latest", gomock.Any()).Return(io.NopCloser(strings.NewReader("")), nil)
+	cli.EXPECT().ImageInspect(gomock.Any(), "ghcr.io/wtnb75/a:latest").Return(image.InspectResponse{}, nil)
+	if name, pathinfo, err := puller.resolve(conf, "a", context.Background()); name != "ghcr.io/wtnb75/a:latest" || pathinfo != "" || err != nil {
+		t.Error("retry", name, pathinfo, err)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+)
+
+// scriptEnv returns environment variables configured for the script.
+// inherited variables are overridden by --env, and --env by --env-file
+func (conf SrvConfig) scriptEnv() (map[string]string, error) {
+	res := map[string]string{}
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		for _, pat := range conf.InheritEnv {
+			if ok, _ := path.Match(pat, k); ok {
+				res[k] = v
+				break
+			}
+		}
+	}
+	for _, kv := range conf.Env {
+		k, v, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid env: %s", kv)
+		}
+		res[k] = v
+	}
+	for _, kv := range conf.EnvFile {
+		k, fn, ok := strings.Cut(kv, "=")
+		if !ok || k == "" {
+			return nil, fmt.Errorf("invalid env-file: %s", kv)
+		}
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			slog.Error("read env-file", "error", err, "name", k, "filename", fn)
+			return nil, err
+		}
+		res[k] = strings.TrimRight(string(data), "\r\n")
+	}
+	return res, nil
+}
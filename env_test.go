@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScriptEnv(t *testing.T) {
+	t.Setenv("HTTPCGI_TEST_A", "a")
+	t.Setenv("HTTPCGI_TEST_B", "b")
+	t.Setenv("HTTPCGI_OTHER", "other")
+	secret := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(secret, []byte("s3cr3t\n"), 0600); err != nil {
+		t.Fatal("writefile", err)
+	}
+	conf := SrvConfig{}
+	conf.InheritEnv = []string{"HTTPCGI_TEST_*"}
+	conf.Env = []string{"HTTPCGI_TEST_B=static", "EMPTY=", "WITH_EQ=a=b"}
+	conf.EnvFile = []string{"SECRET=" + secret}
+	env, err := conf.scriptEnv()
+	if err != nil {
+		t.Fatal("error", err)
+	}
+	expected := map[string]string{
+		"HTTPCGI_TEST_A": "a",
+		"HTTPCGI_TEST_B": "static",
+		"EMPTY":          "",
+		"WITH_EQ":        "a=b",
+		"SECRET":         "s3cr3t",
+	}
+	if len(env) != len(expected) {
+		t.Error("env", env)
+	}
+	for k, v := range expected {
+		if env[k] != v {
+			t.Errorf("%s: %s != %s", k, env[k], v)
+		}
+	}
+}
+
+func TestScriptEnvError(t *testing.T) {
+	t.Parallel()
+	confs := map[string]SrvConfig{
+		"env":      {SrvConfigBase: SrvConfigBase{Env: []string{"NOVALUE"}}},
+		"env-file": {SrvConfigBase: SrvConfigBase{EnvFile: []string{"KEY=/not/exists"}}},
+		"env-key":  {SrvConfigBase: SrvConfigBase{EnvFile: []string{"=/not/exists"}}},
+	}
+	for name, conf := range confs {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			if _, err := conf.scriptEnv(); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
@@ -2,3 +2,4 @@
 
 rustc hello.rs
 rustc --target wasm32-wasi hello.rs
+(cd httpcgi-guest && cargo build --release --target wasm32-wasip1 --example counter)
@@ -0,0 +1,15 @@
+use httpcgi_guest::{kv, log, request_meta, trace_context, Level};
+
+fn main() {
+    let count: u64 = kv::get("count").and_then(|v| v.parse().ok()).unwrap_or(0) + 1;
+    if let Err(e) = kv::set("count", &count.to_string()) {
+        log(Level::Error, &format!("kv set: {e}"));
+    }
+    log(Level::Info, &format!("count {count}"));
+    println!("Content-Type: text/plain");
+    println!();
+    println!("count: {count}");
+    println!("method: {}", request_meta("method").unwrap_or_default());
+    println!("user-agent: {}", request_meta("header.User-Agent").unwrap_or_default());
+    println!("traceparent: {}", trace_context().unwrap_or_default());
+}
@@ -0,0 +1,170 @@
+//! Host functions of httpcgi for WASM CGI scripts run by the wazero runner.
+//!
+//! Strings are passed by pointer and length. Functions writing into the buffer
+//! return the length of the value and write nothing if it doesn't fit.
+
+#[link(wasm_import_module = "httpcgi")]
+extern "C" {
+    #[link_name = "log"]
+    fn host_log(level: i32, msg: *const u8, msg_len: usize);
+    #[link_name = "trace_context"]
+    fn host_trace_context(buf: *mut u8, buf_len: usize) -> i32;
+    #[link_name = "request_meta"]
+    fn host_request_meta(key: *const u8, key_len: usize, buf: *mut u8, buf_len: usize) -> i32;
+    #[link_name = "kv_get"]
+    fn host_kv_get(key: *const u8, key_len: usize, buf: *mut u8, buf_len: usize) -> i32;
+    #[link_name = "kv_set"]
+    fn host_kv_set(key: *const u8, key_len: usize, value: *const u8, value_len: usize) -> i32;
+    #[link_name = "kv_delete"]
+    fn host_kv_delete(key: *const u8, key_len: usize) -> i32;
+    #[link_name = "http_request"]
+    fn host_http_request(
+        method: *const u8,
+        method_len: usize,
+        url: *const u8,
+        url_len: usize,
+        headers: *const u8,
+        headers_len: usize,
+        body: *const u8,
+        body_len: usize,
+    ) -> i32;
+    #[link_name = "http_response"]
+    fn host_http_response(buf: *mut u8, buf_len: usize) -> i32;
+}
+
+/// Log level, same as slog of Go
+#[derive(Clone, Copy, Debug)]
+pub enum Level {
+    Debug = -4,
+    Info = 0,
+    Warn = 4,
+    Error = 8,
+}
+
+/// Error returned by the host
+#[derive(Debug)]
+pub enum Error {
+    Host,
+    /// the host is not in --wasm-http-allow
+    Denied,
+    /// network error or timeout (--wasm-http-timeout)
+    Failed,
+    /// response exceeds --wasm-http-max-response
+    TooLarge,
+    Invalid,
+}
+
+impl std::fmt::Display for Error {
+    fn fmt(&self, f: &mut std::fmt::Formatter) -> std::fmt::Result {
+        write!(f, "httpcgi host error: {self:?}")
+    }
+}
+
+impl std::error::Error for Error {}
+
+/// call host function with growing buffer. None if not found
+fn read_value(f: impl Fn(*mut u8, usize) -> i32) -> Option<String> {
+    let mut buf = vec![0u8; 256];
+    loop {
+        let n = f(buf.as_mut_ptr(), buf.len());
+        if n < 0 {
+            return None;
+        }
+        let n = n as usize;
+        if n <= buf.len() {
+            buf.truncate(n);
+            return Some(String::from_utf8_lossy(&buf).into_owned());
+        }
+        buf.resize(n, 0);
+    }
+}
+
+/// Write a log with the script name and trace id
+pub fn log(level: Level, msg: &str) {
+    unsafe { host_log(level as i32, msg.as_ptr(), msg.len()) }
+}
+
+/// W3C traceparent of the current request. None if not traced
+pub fn trace_context() -> Option<String> {
+    read_value(|buf, len| unsafe { host_trace_context(buf, len) }).filter(|s| !s.is_empty())
+}
+
+/// Metadata of the request not in CGI variables.
+/// "method", "uri", "host", "proto", "remote_addr", "scheme", "tls_server_name" and "header.NAME"
+pub fn request_meta(key: &str) -> Option<String> {
+    read_value(|buf, len| unsafe { host_request_meta(key.as_ptr(), key.len(), buf, len) })
+}
+
+/// Key-value store of the route (--wasm-kv-file)
+pub mod kv {
+    use super::*;
+
+    pub fn get(key: &str) -> Option<String> {
+        read_value(|buf, len| unsafe { host_kv_get(key.as_ptr(), key.len(), buf, len) })
+    }
+
+    pub fn set(key: &str, value: &str) -> Result<(), Error> {
+        match unsafe { host_kv_set(key.as_ptr(), key.len(), value.as_ptr(), value.len()) } {
+            0 => Ok(()),
+            _ => Err(Error::Host),
+        }
+    }
+
+    pub fn delete(key: &str) -> Result<(), Error> {
+        match unsafe { host_kv_delete(key.as_ptr(), key.len()) } {
+            0 => Ok(()),
+            _ => Err(Error::Host),
+        }
+    }
+}
+
+/// Outbound HTTP restricted by --wasm-http-allow
+pub mod http {
+    use super::*;
+
+    /// Response of the upstream
+    #[derive(Debug)]
+    pub struct Response {
+        pub status: u16,
+        pub headers: Vec<(String, String)>,
+        pub body: Vec<u8>,
+    }
+
+    /// Send a request. headers are "Name: value" pairs
+    pub fn request(method: &str, url: &str, headers: &[(&str, &str)], body: &[u8]) -> Result<Response, Error> {
+        let headers: String = headers.iter().map(|(k, v)| format!("{k}: {v}\n")).collect();
+        let n = unsafe {
+            host_http_request(
+                method.as_ptr(),
+                method.len(),
+                url.as_ptr(),
+                url.len(),
+                headers.as_ptr(),
+                headers.len(),
+                body.as_ptr(),
+                body.len(),
+            )
+        };
+        match n {
+            -1 => return Err(Error::Denied),
+            -2 => return Err(Error::Failed),
+            -3 => return Err(Error::TooLarge),
+            n if n < 0 => return Err(Error::Invalid),
+            _ => {}
+        }
+        let mut buf = vec![0u8; n as usize];
+        if unsafe { host_http_response(buf.as_mut_ptr(), buf.len()) } != n {
+            return Err(Error::Host);
+        }
+        // status line, headers, empty line and body
+        let sep = buf.windows(2).position(|w| w == b"\n\n").ok_or(Error::Invalid)?;
+        let head = String::from_utf8_lossy(&buf[..sep]).into_owned();
+        let mut lines = head.lines();
+        let status = lines.next().and_then(|s| s.parse().ok()).ok_or(Error::Invalid)?;
+        let headers = lines
+            .filter_map(|l| l.split_once(": "))
+            .map(|(k, v)| (k.to_string(), v.to_string()))
+            .collect();
+        Ok(Response { status, headers, body: buf[sep + 2..].to_vec() })
+    }
+}
@@ -4,42 +4,42 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
+	"maps"
+	"net/http"
+	"os"
+	"slices"
 	"strings"
+	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/mount"
 	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/stdcopy"
 	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
 	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 // DockerRunner implements CGI Runner execute by docker
 type DockerRunner struct {
-	cli client.APIClient
+	cli     client.APIClient
+	index   *imageIndex       // nil: list images on each request
+	pool    *containerPool    // nil: container per request
+	tracker *containerTracker // nil: containers are not labeled
+	puller  *imagePuller      // nil: images are not pulled
 }
 
-func (runner DockerRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
-	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
-	_, span2 := otel.Tracer("").Start(ctx, "docker-run")
-	defer span2.End()
-	env := []string{}
-	for k, v := range envvar {
-		env = append(env, k+"="+v)
-	}
-	contConfig := container.Config{
-		Image:      cmdname,
-		Env:        env,
-		Tty:        false,
-		WorkingDir: conf.DockerWorkDir,
-	}
+// parseMounts parses --docker-volume. src:target[:opts]
+func parseMounts(specs []string) []mount.Mount {
 	mounts := []mount.Mount{}
-	for _, v := range conf.DockerMounts {
+	for _, v := range specs {
 		sp := strings.Split(v, ":")
 		rdonly := false
 		mountType := mount.TypeBind
@@ -77,8 +77,100 @@ func (runner DockerRunner) Run(conf SrvConfig, cmdname string, envvar map[string
 			ReadOnly: rdonly,
 		})
 	}
-	hostConfig := container.HostConfig{
-		Mounts: mounts,
+	return mounts
+}
+
+// hostConfig returns container.HostConfig with mounts and resource limits
+func (runner DockerRunner) hostConfig(conf SrvConfig, ctx context.Context) container.HostConfig {
+	mounts := parseMounts(conf.DockerMounts)
+	if scratchDir(ctx) != "" && !slices.ContainsFunc(mounts, func(m mount.Mount) bool { return m.Target == "/tmp" }) {
+		mounts = append(mounts, mount.Mount{
+			Type:         mount.TypeTmpfs,
+			Target:       "/tmp",
+			TmpfsOptions: &mount.TmpfsOptions{SizeBytes: int64(conf.ScratchQuota)},
+		})
+	}
+	pidsLimit := conf.DockerPidsLimit
+	return container.HostConfig{
+		Mounts:         mounts,
+		NetworkMode:    container.NetworkMode(conf.DockerNetwork),
+		ReadonlyRootfs: !conf.DockerWritable,
+		CapDrop:        []string{"ALL"},
+		CapAdd:         conf.DockerCapAdd,
+		SecurityOpt:    []string{"no-new-privileges:true"},
+		Resources: container.Resources{
+			Memory:    int64(conf.DockerMemory),
+			NanoCPUs:  int64(conf.DockerCPUs * 1e9),
+			PidsLimit: &pidsLimit,
+		},
+	}
+}
+
+func (runner DockerRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
+	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
+	ctx, span2 := otel.Tracer("").Start(ctx, "docker-run")
+	defer span2.End()
+	startTime := time.Now()
+	defer func() {
+		span2.SetAttributes(attribute.Float64("duration", time.Since(startTime).Seconds()))
+	}()
+	labels, ok := runner.index.labels(cmdname)
+	if !ok {
+		// not indexed yet, e.g. just pulled
+		insp, err := runner.cli.ImageInspect(ctx, cmdname)
+		if err != nil {
+			slog.Error("imageInspect", "error", err)
+			return err
+		}
+		if insp.Config != nil {
+			labels = insp.Config.Labels
+		}
+	}
+	settings, err := parseImageLabels(labels)
+	if err != nil {
+		slog.Error("image labels", "image", cmdname, "error", err)
+		return err
+	}
+	conf = settings.apply(conf)
+	// envvar belongs to the caller
+	envvar = maps.Clone(envvar)
+	for k, v := range settings.Env {
+		if _, ok := envvar[k]; !ok {
+			envvar[k] = v
+		}
+	}
+	env := []string{}
+	for k, v := range envvar {
+		if k == "TMPDIR" && scratchDir(ctx) != "" {
+			// per-request scratch is tmpfs in the container
+			v = "/tmp"
+		}
+		env = append(env, k+"="+v)
+	}
+	contConfig := container.Config{
+		Image:        cmdname,
+		Env:          env,
+		Tty:          false,
+		WorkingDir:   conf.DockerWorkDir,
+		User:         conf.DockerUser,
+		AttachStdin:  true,
+		AttachStdout: true,
+		AttachStderr: true,
+		OpenStdin:    true,
+		StdinOnce:    true,
+		Labels:       runner.tracker.labels(cmdname, envvar, ctx),
+	}
+	hostConfig := runner.hostConfig(conf, ctx)
+	if conf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, conf.Timeout, fmt.Errorf("%w %v", ErrTimeout, conf.Timeout))
+		defer cancel()
+	}
+	if runner.pool != nil {
+		if c := runner.pool.acquire(ctx, contConfig, hostConfig); c != nil {
+			span2.AddEvent("pooled container")
+			return runner.pool.exec(ctx, c, contConfig, stdin, stdout, stderr)
+		}
 	}
 	cres, err := runner.cli.ContainerCreate(ctx, &contConfig, &hostConfig, nil, nil, "")
 	span2.AddEvent("done docker-create")
@@ -86,7 +178,33 @@ func (runner DockerRunner) Run(conf SrvConfig, cmdname string, envvar map[string
 		slog.Error("containerCreate", "error", err)
 		return err
 	}
-	defer runner.cli.ContainerRemove(ctx, cres.ID, container.RemoveOptions{})
+	runner.tracker.add(cres.ID)
+	// container should be removed even if the request is cancelled. if failed, removed by gc
+	defer func() {
+		if err := runner.cli.ContainerRemove(context.WithoutCancel(ctx), cres.ID, container.RemoveOptions{Force: true}); err != nil {
+			slog.Error("containerRemove", "id", cres.ID, "error", err)
+		}
+		runner.tracker.remove(cres.ID)
+	}()
+	if lw, ok := stderr.(*logWriter); ok {
+		lw = lw.With("container", cres.ID)
+		defer lw.Close()
+		stderr = lw
+	}
+	slog.Debug("docker-attach")
+	hr, err := runner.cli.ContainerAttach(ctx, cres.ID, container.AttachOptions{
+		Stream: true,
+		Stdin:  true,
+		Stdout: true,
+		Stderr: true,
+	})
+	span2.AddEvent("done docker-attach")
+	if err != nil {
+		slog.Error("containerAttach", "error", err)
+		return err
+	}
+	defer hr.Close()
+	outDone := attachStreams(hr, stdin, stdout, stderr)
 	slog.Debug("docker-start")
 	if err = runner.cli.ContainerStart(ctx, cres.ID, container.StartOptions{}); err != nil {
 		slog.Error("containerStart", "error", err)
@@ -95,84 +213,176 @@ func (runner DockerRunner) Run(conf SrvConfig, cmdname string, envvar map[string
 	span2.AddEvent("done docker-start")
 	slog.Debug("docker-wait")
 	stCh, errCh := runner.cli.ContainerWait(ctx, cres.ID, container.WaitConditionNotRunning)
+	var exitCode int64
 	select {
 	case err := <-errCh:
-		if err != nil {
+		if err != nil && ctx.Err() == nil {
 			slog.Error("execute error", "error", err)
 			span2.AddEvent("execute error")
 			return err
 		}
-	case <-stCh:
-		slog.Debug("docker-done")
+	case st := <-stCh:
+		slog.Debug("docker-done", "status", st.StatusCode)
+		exitCode = st.StatusCode
+	case <-ctx.Done():
+	}
+	if ctx.Err() != nil {
+		span2.AddEvent("cancelled")
+		return runner.kill(ctx, cres.ID)
 	}
 	span2.AddEvent("done docker-wait")
+	// rest of output after the container exited
+	select {
+	case err := <-outDone:
+		span2.AddEvent("done docker-stdcopy")
+		if err != nil {
+			slog.Error("stdcopy", "error", err)
+			return err
+		}
+	case <-ctx.Done():
+		span2.AddEvent("cancelled")
+		return runner.kill(ctx, cres.ID)
+	}
+	oomKilled := false
+	if exitCode != 0 {
+		cinsp, err := runner.cli.ContainerInspect(ctx, cres.ID)
+		if err != nil {
+			slog.Error("containerInspect", "error", err)
+		} else if cinsp.State != nil {
+			oomKilled = cinsp.State.OOMKilled
+		}
+	}
+	return exitStatus(ctx, cmdname, cres.ID, int(exitCode), oomKilled)
+}
 
-	slog.Debug("docker-logs")
-	out, err := runner.cli.ContainerLogs(ctx, cres.ID, container.LogsOptions{ShowStdout: true})
-	span2.AddEvent("done docker-logs")
-	if err != nil {
-		slog.Error("logs error", "error", err)
-		return err
+// exitStatus records exit status to the span. returns ExitCodeError if the script failed
+func exitStatus(ctx context.Context, script string, id string, code int, oomKilled bool) error {
+	span := trace.SpanFromContext(ctx)
+	span.SetAttributes(attribute.Int("exit_code", code), attribute.Bool("oom_killed", oomKilled))
+	if code == 0 {
+		return nil
 	}
+	slog.Warn("exit", "script", script, "container", id, "code", code, "oom-killed", oomKilled)
+	return ExitCodeError{Code: code}
+}
+
+// AdminHandler implements AdminRunner. shows containers created by this instance
+func (runner DockerRunner) AdminHandler() http.Handler {
+	return runner.tracker.handler(runner.cli)
+}
 
-	slog.Debug("docker-stdcopy")
-	stdcopy.StdCopy(stdout, stderr, out)
-	span2.AddEvent("done docker-stdcopy")
-	return nil
+// attachStreams pipes stdin to attached connection and demultiplexes its output.
+// returned channel receives result after the output is closed
+func attachStreams(hr types.HijackedResponse, stdin io.ReadCloser, stdout io.Writer, stderr io.Writer) <-chan error {
+	outDone := make(chan error, 1)
+	go func() {
+		_, err := stdcopy.StdCopy(stdout, stderr, hr.Reader)
+		outDone <- err
+	}()
+	go func() {
+		if err := DoPipe(stdin, hr.Conn); err != nil {
+			slog.Error("stdin", "error", err)
+		}
+		if err := hr.CloseWrite(); err != nil {
+			slog.Error("stdin close", "error", err)
+		}
+	}()
+	return outDone
+}
+
+// kill kills the container on cancellation. returns the cause
+func (runner DockerRunner) kill(ctx context.Context, id string) error {
+	slog.Warn("cancelled", "id", id, "error", context.Cause(ctx))
+	if err := runner.cli.ContainerKill(context.WithoutCancel(ctx), id, "KILL"); err != nil {
+		slog.Error("containerKill", "error", err)
+	}
+	return context.Cause(ctx)
 }
 
 func (runner DockerRunner) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
 	_, span2 := otel.Tracer("").Start(ctx, "docker-exists")
 	defer span2.End()
-	imgOpts := image.ListOptions{
-		All:            false,
-		ContainerCount: false,
+	idx := runner.index
+	if idx == nil {
+		idx = newImageIndex()
+		err := idx.sync(ctx, runner.cli)
+		span2.AddEvent("done imagelist")
+		if err != nil {
+			span2.SetStatus(codes.Error, "image list")
+			slog.Error("image list", "error", err)
+			return "", "", err
+		}
 	}
-	imgs, err := runner.cli.ImageList(context.Background(), imgOpts)
-	span2.AddEvent("done imagelist")
-	if err != nil {
-		span2.SetStatus(codes.Error, "image list")
-		slog.Error("image list", "error", err)
-		return "", "", err
-	}
-	var name, pathinfo string
-	for _, i := range imgs {
-		for _, t := range i.RepoTags {
-			if !strings.HasPrefix(t, conf.BaseDir) {
-				continue
-			}
-			if !strings.HasSuffix(t, conf.Suffix) {
-				continue
-			}
-			namepart := t[len(conf.BaseDir) : len(t)-len(conf.Suffix)]
-			slog.Debug("namepart", "tag", t, "name", namepart)
-			if namepart == path {
-				span2.SetStatus(codes.Ok, "found")
-				span2.SetAttributes(attribute.String("tag", t))
-				return t, "", nil
-			} else if strings.HasPrefix(path, namepart+"/") {
-				name = t
-				pathinfo = path[len(namepart):]
-			}
+	name, pathinfo, ok := idx.resolve(conf.BaseDir, conf.Suffix, path, conf.DockerLabel)
+	if !ok && runner.puller != nil && len(conf.DockerPullAllow) != 0 {
+		var err error
+		if name, pathinfo, err = runner.puller.resolve(conf, path, ctx); err != nil {
+			span2.SetStatus(codes.Error, "pull")
+			slog.Warn("pull", "path", path, "error", err)
+			return "", "", fmt.Errorf("image not found: %s: %w", path, err)
 		}
+		span2.AddEvent("done pull")
+		ok = true
 	}
-	if len(pathinfo) == 0 {
+	if !ok {
 		span2.SetStatus(codes.Error, "not found")
 		return "", "", fmt.Errorf("image not found: %s", path)
 	}
+	span2.SetStatus(codes.Ok, "found")
 	span2.SetAttributes(attribute.String("tag", name), attribute.String("pathinfo", pathinfo))
 	return name, pathinfo, nil
 }
 
+// dockerInstance returns instance label of the containers.
+// gc removes containers of other processes with the same instance, so it requires explicit one.
+// the default is unique to the process
+func dockerInstance(conf SrvConfig) (string, error) {
+	if conf.DockerInstance != "" {
+		return conf.DockerInstance, nil
+	}
+	if conf.DockerGC > 0 {
+		return "", errors.New("--docker-gc requires --docker-instance unique to the process")
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return host + "-" + strings.ToLower(rand.Text()[:8]), nil
+}
+
 func init() {
-	runnerMap["docker"] = func(SrvConfig) Runner {
+	runnerMap["docker"] = func(conf SrvConfig) Runner {
 		cl, err := client.NewClientWithOpts(client.FromEnv, client.WithAPIVersionNegotiation())
 		if err != nil {
 			slog.Error("docker client", "error", err)
 			panic(fmt.Sprintf("docker client error: %s", err))
 		}
+		idx := newImageIndex()
+		if err := idx.sync(context.Background(), cl); err != nil {
+			// not fatal. the watch syncs again on reconnect and resync
+			slog.Error("image index sync", "error", err)
+		}
+		go idx.watch(context.Background(), cl, conf.DockerResync)
+		instance, err := dockerInstance(conf)
+		if err != nil {
+			slog.Error("docker instance", "error", err)
+			panic(fmt.Sprintf("docker instance error: %s", err))
+		}
+		tracker := newContainerTracker(instance)
+		if conf.DockerGC > 0 {
+			go tracker.watch(context.Background(), cl, conf.DockerGC)
+		}
+		var pool *containerPool
+		if conf.DockerPool > 0 {
+			pool = newContainerPool(cl, tracker, conf.DockerPool, conf.DockerPoolMaxUses, strings.Fields(conf.DockerPoolIdleCmd))
+			go pool.watch(context.Background(), conf.DockerPoolCheck)
+		}
 		return DockerRunner{
-			cli: cl,
+			cli:     cl,
+			index:   idx,
+			pool:    pool,
+			tracker: tracker,
+			puller:  newImagePuller(cl, idx),
 		}
 	}
 }
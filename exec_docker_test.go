@@ -5,17 +5,43 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"net"
+	"slices"
 	"testing"
 	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/golang/mock/gomock"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/wtnb75/httpcgi/mock_client"
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
 )
 
+// fakeAttach returns attached connection of fake container.
+// it reads stdin of stdinLen bytes, writes stdout and stderr, then exits
+func fakeAttach(stdinLen int, out string, errout string) (types.HijackedResponse, <-chan []byte) {
+	cl, srv := net.Pipe()
+	ch := make(chan []byte, 1)
+	go func() {
+		defer srv.Close()
+		buf := make([]byte, stdinLen)
+		io.ReadFull(srv, buf)
+		ch <- buf
+		fmt.Fprint(stdcopy.NewStdWriter(srv, stdcopy.Stdout), out)
+		fmt.Fprint(stdcopy.NewStdWriter(srv, stdcopy.Stderr), errout)
+	}()
+	return types.NewHijackedResponse(cl, ""), ch
+}
+
 func TestDockerExists(t *testing.T) {
 	t.Parallel()
 	ctrl := gomock.NewController(t)
@@ -111,21 +137,258 @@ func TestDockerRun(t *testing.T) {
 	stdin := io.NopCloser(bytes.NewBufferString("hello"))
 	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{}, nil)
 	cres := container.CreateResponse{ID: "id123"}
 	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").Return(cres, nil)
 	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).Return(nil)
 	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	hr, ch_stdin := fakeAttach(5, "Content-Type: text/plain\n\nworld", "error output")
+	cli.EXPECT().ContainerAttach(gomock.Any(), "id123", gomock.Any()).Return(hr, nil)
 	ch_exit := make(chan container.WaitResponse, 1)
 	ch_err := make(chan error, 1)
 	cli.EXPECT().ContainerWait(gomock.Any(), "id123", container.WaitConditionNotRunning).Return(ch_exit, ch_err)
-	buf := []byte{}
-	output := io.NopCloser(bytes.NewBuffer(buf))
-	cli.EXPECT().ContainerLogs(gomock.Any(), "id123", gomock.Any()).Return(output, nil)
 	ch_exit <- container.WaitResponse{}
 	// ch_err <- fmt.Errorf("hello %s", "world")
 	err := runner.Run(conf, "path1", envs, stdin, stdout, stderr, context.Background())
 	if err != nil {
 		t.Error("err", err)
 	}
+	if string(<-ch_stdin) != "hello" {
+		t.Error("stdin")
+	}
+	if stdout.String() != "Content-Type: text/plain\n\nworld" {
+		t.Error("stdout", stdout.String())
+	}
+	if stderr.String() != "error output" {
+		t.Error("stderr", stderr.String())
+	}
 	return
 }
+
+func TestDockerRunCancel(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	runner := DockerRunner{cli: cli}
+	conf := SrvConfig{}
+	conf.Timeout = time.Duration(1000_000_000)
+	envs := map[string]string{}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{}, nil)
+	cres := container.CreateResponse{ID: "id123"}
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").Return(cres, nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	hr, _ := fakeAttach(0, "", "")
+	cli.EXPECT().ContainerAttach(gomock.Any(), "id123", gomock.Any()).Return(hr, nil)
+	ch_exit := make(chan container.WaitResponse, 1)
+	ch_err := make(chan error, 1)
+	cli.EXPECT().ContainerWait(gomock.Any(), "id123", container.WaitConditionNotRunning).DoAndReturn(
+		func(context.Context, string, container.WaitCondition) (<-chan container.WaitResponse, <-chan error) {
+			cancel()
+			return ch_exit, ch_err
+		})
+	cli.EXPECT().ContainerKill(gomock.Any(), "id123", "KILL").Return(nil)
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).DoAndReturn(
+		func(ctx context.Context, id string, opts container.RemoveOptions) error {
+			if ctx.Err() != nil {
+				t.Error("remove with cancelled context")
+			}
+			return nil
+		})
+	err := runner.Run(conf, "path1", envs, stdin, stdout, stderr, ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Error("err", err)
+	}
+}
+
+func TestDockerRunScratch(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	runner := DockerRunner{cli: cli}
+	conf := SrvConfig{}
+	conf.Timeout = time.Duration(1000_000_000)
+	conf.ScratchQuota = 1024 * 1024
+	envs := map[string]string{"TMPDIR": "/host/tmp/dir"}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	ctx := withScratchDir(context.Background(), "/host/tmp/dir")
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{}, nil)
+	cres := container.CreateResponse{ID: "id123"}
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").DoAndReturn(
+		func(ctx context.Context, cconf *container.Config, hconf *container.HostConfig,
+			_ *network.NetworkingConfig, _ *ocispec.Platform, _ string) (container.CreateResponse, error) {
+			if !slices.Contains(cconf.Env, "TMPDIR=/tmp") {
+				t.Error("env", cconf.Env)
+			}
+			if len(hconf.Mounts) != 1 || hconf.Mounts[0].Target != "/tmp" ||
+				hconf.Mounts[0].TmpfsOptions.SizeBytes != 1024*1024 {
+				t.Error("mounts", hconf.Mounts)
+			}
+			return cres, nil
+		})
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	ch_exit := make(chan container.WaitResponse, 1)
+	ch_err := make(chan error, 1)
+	cli.EXPECT().ContainerWait(gomock.Any(), "id123", container.WaitConditionNotRunning).Return(ch_exit, ch_err)
+	hr, _ := fakeAttach(0, "", "")
+	cli.EXPECT().ContainerAttach(gomock.Any(), "id123", gomock.Any()).Return(hr, nil)
+	ch_exit <- container.WaitResponse{}
+	err := runner.Run(conf, "path1", envs, stdin, stdout, stderr, ctx)
+	if err != nil {
+		t.Error("err", err)
+	}
+}
+
+func TestDockerRunLimits(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	runner := DockerRunner{cli: cli}
+	conf := SrvConfig{}
+	conf.DockerMemory = 256 * 1024 * 1024
+	conf.DockerCPUs = 0.5
+	conf.DockerPidsLimit = 64
+	conf.DockerNetwork = "none"
+	conf.DockerCapAdd = []string{"NET_BIND_SERVICE"}
+	envs := map[string]string{}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{}, nil)
+	cres := container.CreateResponse{ID: "id123"}
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").DoAndReturn(
+		func(ctx context.Context, cconf *container.Config, hconf *container.HostConfig,
+			_ *network.NetworkingConfig, _ *ocispec.Platform, _ string) (container.CreateResponse, error) {
+			if hconf.Memory != 256*1024*1024 {
+				t.Error("memory", hconf.Memory)
+			}
+			if hconf.NanoCPUs != 500_000_000 {
+				t.Error("cpus", hconf.NanoCPUs)
+			}
+			if hconf.PidsLimit == nil || *hconf.PidsLimit != 64 {
+				t.Error("pids", hconf.PidsLimit)
+			}
+			if !hconf.ReadonlyRootfs {
+				t.Error("rootfs", hconf.ReadonlyRootfs)
+			}
+			if hconf.NetworkMode != "none" {
+				t.Error("network", hconf.NetworkMode)
+			}
+			if !slices.Equal(hconf.CapDrop, []string{"ALL"}) || !slices.Equal(hconf.CapAdd, []string{"NET_BIND_SERVICE"}) {
+				t.Error("caps", hconf.CapDrop, hconf.CapAdd)
+			}
+			if !slices.Contains(hconf.SecurityOpt, "no-new-privileges:true") {
+				t.Error("secopt", hconf.SecurityOpt)
+			}
+			return cres, nil
+		})
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	ch_exit := make(chan container.WaitResponse, 1)
+	ch_err := make(chan error, 1)
+	cli.EXPECT().ContainerWait(gomock.Any(), "id123", container.WaitConditionNotRunning).Return(ch_exit, ch_err)
+	hr, _ := fakeAttach(0, "", "")
+	cli.EXPECT().ContainerAttach(gomock.Any(), "id123", gomock.Any()).Return(hr, nil)
+	ch_exit <- container.WaitResponse{}
+	err := runner.Run(conf, "path1", envs, stdin, stdout, stderr, context.Background())
+	if err != nil {
+		t.Error("err", err)
+	}
+}
+
+func TestDockerRunTimeout(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	runner := DockerRunner{cli: cli}
+	conf := SrvConfig{}
+	conf.Timeout = 100 * time.Millisecond
+	envs := map[string]string{}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{}, nil)
+	cres := container.CreateResponse{ID: "id123"}
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").Return(cres, nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	hr, _ := fakeAttach(0, "", "")
+	cli.EXPECT().ContainerAttach(gomock.Any(), "id123", gomock.Any()).Return(hr, nil)
+	ch_exit := make(chan container.WaitResponse, 1)
+	ch_err := make(chan error, 1)
+	cli.EXPECT().ContainerWait(gomock.Any(), "id123", container.WaitConditionNotRunning).Return(ch_exit, ch_err)
+	cli.EXPECT().ContainerKill(gomock.Any(), "id123", "KILL").Return(nil)
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	err := runner.Run(conf, "path1", envs, stdin, stdout, stderr, context.Background())
+	if !errors.Is(err, ErrTimeout) {
+		t.Error("err", err)
+	}
+	if errorStatus(err) != 504 {
+		t.Error("status", errorStatus(err))
+	}
+}
+
+func TestDockerRunExitCode(t *testing.T) {
+	t.Parallel()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	cli := mock_client.NewMockAPIClient(ctrl)
+	runner := DockerRunner{cli: cli}
+	conf := SrvConfig{}
+	envs := map[string]string{}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	stdout := &bytes.Buffer{}
+	stderr := newLogWriter("script", "path1")
+	cli.EXPECT().ImageInspect(gomock.Any(), "path1").Return(image.InspectResponse{}, nil)
+	cres := container.CreateResponse{ID: "id123"}
+	cli.EXPECT().ContainerCreate(gomock.Any(), gomock.Any(), gomock.Any(), nil, nil, "").Return(cres, nil)
+	cli.EXPECT().ContainerRemove(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	cli.EXPECT().ContainerStart(gomock.Any(), "id123", gomock.Any()).Return(nil)
+	ch_exit := make(chan container.WaitResponse, 1)
+	ch_err := make(chan error, 1)
+	cli.EXPECT().ContainerWait(gomock.Any(), "id123", container.WaitConditionNotRunning).Return(ch_exit, ch_err)
+	hr, _ := fakeAttach(0, "", "out of memory\n")
+	cli.EXPECT().ContainerAttach(gomock.Any(), "id123", gomock.Any()).Return(hr, nil)
+	cli.EXPECT().ContainerInspect(gomock.Any(), "id123").Return(container.InspectResponse{
+		ContainerJSONBase: &container.ContainerJSONBase{State: &container.State{OOMKilled: true}},
+	}, nil)
+	ch_exit <- container.WaitResponse{StatusCode: 137}
+	err := runner.Run(conf, "path1", envs, stdin, stdout, stderr, context.Background())
+	var exitErr ExitCodeError
+	if !errors.As(err, &exitErr) || exitErr.Code != 137 {
+		t.Error("err", err)
+	}
+	if errorStatus(err) != 502 {
+		t.Error("status", errorStatus(err))
+	}
+}
+
+func TestExitStatus(t *testing.T) {
+	t.Parallel()
+	sr := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr))
+	ctx, span := tp.Tracer("").Start(context.Background(), "docker-run")
+	if err := exitStatus(ctx, "path1", "id123", 0, false); err != nil {
+		t.Error("exit 0", err)
+	}
+	if err := exitStatus(ctx, "path1", "id123", 137, true); err != (ExitCodeError{Code: 137}) {
+		t.Error("exit 137", err)
+	}
+	span.End()
+	attrs := map[attribute.Key]attribute.Value{}
+	for _, kv := range sr.Ended()[0].Attributes() {
+		attrs[kv.Key] = kv.Value
+	}
+	if attrs["exit_code"].AsInt64() != 137 || !attrs["oom_killed"].AsBool() {
+		t.Error("attributes", attrs)
+	}
+}
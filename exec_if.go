@@ -3,10 +3,11 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"io"
-	"log"
 	"log/slog"
+	"maps"
 	"net"
 	"net/http"
 	"os"
@@ -21,6 +22,21 @@ import (
 	"go.opentelemetry.io/otel/propagation"
 )
 
+// ErrTimeout is returned by Runner.Run when the script exceeds the timeout
+var ErrTimeout = errors.New("timeout")
+
+// ExitCodeError is returned by Runner.Run when the script exits with non-zero code
+type ExitCodeError struct {
+	Code int
+}
+
+func (e ExitCodeError) Error() string {
+	return fmt.Sprintf("exit status %d", e.Code)
+}
+
+// statusClientClosed is non-standard status code for client closed request (nginx)
+const statusClientClosed = 499
+
 // Runner is interface to run CGI
 type Runner interface {
 	Run(conf SrvConfig, cmdname string, envvar map[string]string,
@@ -29,7 +45,13 @@ type Runner interface {
 	Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error)
 }
 
-// OutputFilter converts CGI output to http.ResponseWriter
+// AdminRunner is optional interface of Runner which serves admin view
+type AdminRunner interface {
+	AdminHandler() http.Handler
+}
+
+// OutputFilter converts CGI output to http.ResponseWriter.
+// status code is 0 if the header is not written
 func OutputFilter(stdout io.Reader, w http.ResponseWriter) (int, error) {
 	rd := bufio.NewReader(stdout)
 	statusCode := http.StatusOK
@@ -37,7 +59,7 @@ func OutputFilter(stdout io.Reader, w http.ResponseWriter) (int, error) {
 		line, _, err := rd.ReadLine()
 		if err != nil {
 			slog.Error("read header error:", "error", err)
-			return statusCode, err
+			return 0, err
 		}
 		if len(line) == 0 {
 			slog.Info("header finished")
@@ -47,7 +69,7 @@ func OutputFilter(stdout io.Reader, w http.ResponseWriter) (int, error) {
 		before, after, ok := strings.Cut(linestr, ":")
 		if !ok {
 			slog.Warn("header format error", "line", linestr)
-			return statusCode, fmt.Errorf("invalid header format")
+			return 0, fmt.Errorf("invalid header format")
 		}
 		k := strings.TrimSpace(before)
 		v := strings.TrimSpace(after)
@@ -93,21 +115,65 @@ func splitPathInfo(basedir string, path string, suffix string) (string, string,
 	return "", "", fmt.Errorf("not found %s", path)
 }
 
+// workDir returns working directory for the script. empty means current directory of httpcgi
+func workDir(conf SrvConfig, cmdname string) string {
+	switch conf.WorkDir {
+	case "script":
+		return filepath.Dir(filepath.Join(conf.BaseDir, cmdname))
+	case "base":
+		return conf.BaseDir
+	}
+	return conf.WorkDir
+}
+
+type requestKey struct{}
+
+// withRequest stores the HTTP request in the context, for runners needing more than CGI variables
+func withRequest(ctx context.Context, r *http.Request) context.Context {
+	return context.WithValue(ctx, requestKey{}, r)
+}
+
+// requestFrom returns the HTTP request of the context. nil if not exists
+func requestFrom(ctx context.Context) *http.Request {
+	r, _ := ctx.Value(requestKey{}).(*http.Request)
+	return r
+}
+
+// errorStatus returns HTTP status code for the error from Runner.Run
+func errorStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrTimeout), errors.Is(err, ErrHeaderTimeout), errors.Is(err, ErrIdleTimeout):
+		return http.StatusGatewayTimeout
+	case errors.Is(err, ErrScratchQuota):
+		return http.StatusInsufficientStorage
+	case errors.Is(err, context.Canceled):
+		return statusClientClosed
+	case errors.As(err, new(ExitCodeError)):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
 // RunBy executes HTTP request
 func RunBy(opts SrvConfig, runner Runner, w http.ResponseWriter, r *http.Request) error {
 	ctx, span := otel.Tracer("").Start(r.Context(), "run")
 	defer span.End()
 	startTime := time.Now()
 	httpStatus := http.StatusOK
+	var runErr error // failure of the script. status may be already sent
 	defer func() {
-		slog.Info(
-			"access-log", "method", r.Method, "url", r.URL,
+		args := []any{
+			"method", r.Method, "url", r.URL,
 			"remote-addr", r.RemoteAddr,
 			"proto", r.Proto,
 			"user-agent", r.UserAgent(),
 			"status", httpStatus,
 			"elapsed", time.Since(startTime),
-		)
+		}
+		if runErr != nil {
+			args = append(args, "error", runErr)
+		}
+		slog.Info("access-log", args...)
 	}()
 	bn := strings.TrimPrefix(r.URL.Path, opts.Prefix)
 	host, port, err := net.SplitHostPort(opts.Addr)
@@ -132,6 +198,15 @@ func RunBy(opts SrvConfig, runner Runner, w http.ResponseWriter, r *http.Request
 		return err
 	}
 	slog.Debug("memo(path)", "bn", bn, "bn2", bn2, "rest", rest)
+	conf, err := opts.ForScript(bn2)
+	if err != nil {
+		slog.Error("route config", "error", err, "script", bn2)
+		span.SetStatus(codes.Error, "route config")
+		httpStatus = http.StatusInternalServerError
+		w.WriteHeader(httpStatus)
+		fmt.Fprintln(w, "config error")
+		return err
+	}
 	env := map[string]string{
 		"SERVER_SOFTWARE":   "httpcgi/" + version,
 		"SERVER_NAME":       host,
@@ -157,6 +232,28 @@ func RunBy(opts SrvConfig, runner Runner, w http.ResponseWriter, r *http.Request
 		envname := fmt.Sprintf("HTTP_%s", strings.ReplaceAll(strings.ToUpper(k), "-", "_"))
 		env[envname] = strings.Join(v, ";")
 	}
+	extraEnv, err := conf.scriptEnv()
+	if err != nil {
+		slog.Error("script env", "error", err, "script", bn2)
+		span.SetStatus(codes.Error, "script env")
+		httpStatus = http.StatusInternalServerError
+		w.WriteHeader(httpStatus)
+		fmt.Fprintln(w, "config error")
+		return err
+	}
+	tmpdir, err := os.MkdirTemp(conf.ScratchDir, "httpcgi-")
+	if err != nil {
+		slog.Error("scratch dir", "error", err, "script", bn2)
+		span.SetStatus(codes.Error, "scratch dir")
+		httpStatus = http.StatusInternalServerError
+		w.WriteHeader(httpStatus)
+		fmt.Fprintln(w, "scratch dir error")
+		return err
+	}
+	defer removeScratchDir(tmpdir)
+	env["TMPDIR"] = tmpdir
+	// configured variables take precedence. request headers must not shadow them
+	maps.Copy(env, extraEnv)
 	pr, pw := io.Pipe()
 	var wg sync.WaitGroup
 	var outputStatus int
@@ -164,6 +261,8 @@ func RunBy(opts SrvConfig, runner Runner, w http.ResponseWriter, r *http.Request
 		code, err := OutputFilter(pr, w)
 		if err != nil {
 			slog.Error("output filter", "error", err)
+			// unblock the writer side
+			pr.CloseWithError(err)
 		}
 		outputStatus = code
 		span.AddEvent("ofilter finished")
@@ -178,16 +277,38 @@ func RunBy(opts SrvConfig, runner Runner, w http.ResponseWriter, r *http.Request
 			env[fmt.Sprintf("HTTP_%s", escaped)] = v
 		}
 	}
-	err = runner.Run(opts, bn2, env, r.Body, pw, log.Writer(), ctx)
+	runCtx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	if conf.Timeout > 0 {
+		var cancelTimeout context.CancelFunc
+		runCtx, cancelTimeout = context.WithTimeoutCause(
+			runCtx, conf.Timeout, fmt.Errorf("%w %v", ErrTimeout, conf.Timeout))
+		defer cancelTimeout()
+	}
+	runCtx = withScratchDir(runCtx, tmpdir)
+	runCtx = withRequest(runCtx, r)
+	if conf.ScratchQuota > 0 {
+		go watchScratchQuota(runCtx, tmpdir, conf.ScratchQuota, time.Second, cancel)
+	}
+	wd := newScriptWatchdog(pw, conf.HeaderTimeout, conf.IdleTimeout, cancel)
+	stderr := newLogWriter("script", bn2)
+	err = runner.Run(conf, bn2, env, r.Body, wd, stderr, runCtx)
+	stderr.Close()
 	span2.End()
+	pw.Close()
+	wd.Stop()
+	wg.Wait()
 	if err != nil {
+		slog.Warn("exec error", "error", err, "script", bn2)
+		span.RecordError(err)
 		span.SetStatus(codes.Error, "exec error")
-		httpStatus = http.StatusInternalServerError
-		w.WriteHeader(httpStatus)
-		fmt.Fprintf(w, "command error: %s", err)
+		runErr = err
+		if outputStatus == 0 {
+			httpStatus = errorStatus(err)
+			w.WriteHeader(httpStatus)
+			fmt.Fprintf(w, "command error: %s", err)
+		}
 	}
-	pw.Close()
-	wg.Wait()
 	if httpStatus == http.StatusOK && outputStatus != 0 {
 		httpStatus = outputStatus
 	}
@@ -206,16 +327,23 @@ func DoPipe(input io.Reader, output io.Writer) error {
 	return nil
 }
 
-func timeoutWait(wg *sync.WaitGroup, timeout time.Duration) bool {
+// timeoutWait waits wg. returns ErrTimeout or cause of context cancellation. timeout <= 0 is unlimited
+func timeoutWait(ctx context.Context, wg *sync.WaitGroup, timeout time.Duration) error {
 	c := make(chan struct{})
 	go func() {
 		defer close(c)
 		wg.Wait()
 	}()
+	var timer <-chan time.Time
+	if timeout > 0 {
+		timer = time.After(timeout)
+	}
 	select {
 	case <-c:
-		return false // normal
-	case <-time.After(timeout):
-		return true // timeout
+		return nil // normal
+	case <-timer:
+		return fmt.Errorf("%w %v", ErrTimeout, timeout)
+	case <-ctx.Done():
+		return context.Cause(ctx)
 	}
 }
@@ -3,10 +3,16 @@ package main
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -72,6 +78,18 @@ func TestDoPipeReadClose(t *testing.T) {
 
 type runner1 struct{}
 type runner2 struct{}
+type runner3 struct {
+	err error
+}
+type runner4 struct {
+	tmpdir *string
+}
+type runner5 struct {
+	env map[string]string
+}
+type runner6 struct {
+	err error
+}
 type writer struct {
 	out *bytes.Buffer
 }
@@ -94,6 +112,49 @@ func (runner runner2) Run(conf SrvConfig, cmdname string, envvar map[string]stri
 	return nil
 }
 
+func (runner runner3) Run(conf SrvConfig, cmdname string, envvar map[string]string,
+	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
+	return runner.err
+}
+
+func (runner runner4) Run(conf SrvConfig, cmdname string, envvar map[string]string,
+	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
+	*runner.tmpdir = envvar["TMPDIR"]
+	if scratchDir(ctx) != envvar["TMPDIR"] {
+		return fmt.Errorf("scratch dir mismatch %s", scratchDir(ctx))
+	}
+	if err := os.WriteFile(filepath.Join(envvar["TMPDIR"], "file"), []byte("hello"), 0644); err != nil {
+		return err
+	}
+	fmt.Fprintln(stdout, "Content-Type: text/plain")
+	fmt.Fprintln(stdout, "")
+	return nil
+}
+
+func (runner *runner5) Run(conf SrvConfig, cmdname string, envvar map[string]string,
+	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
+	runner.env = envvar
+	fmt.Fprintln(stdout, "Content-Type: text/plain")
+	fmt.Fprintln(stdout, "")
+	return nil
+}
+
+func (runner *runner5) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
+	return splitPathInfo(conf.BaseDir, path, conf.Suffix)
+}
+
+func (runner runner6) Run(conf SrvConfig, cmdname string, envvar map[string]string,
+	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
+	fmt.Fprintln(stdout, "Status: 201")
+	fmt.Fprintln(stdout, "")
+	fmt.Fprintln(stdout, "partial")
+	return runner.err
+}
+
+func (runner runner6) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
+	return splitPathInfo(conf.BaseDir, path, conf.Suffix)
+}
+
 func (runner runner1) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
 	return splitPathInfo(conf.BaseDir, path, conf.Suffix)
 }
@@ -102,6 +163,14 @@ func (runner runner2) Exists(conf SrvConfig, path string, ctx context.Context) (
 	return splitPathInfo(conf.BaseDir, path, conf.Suffix)
 }
 
+func (runner runner3) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
+	return splitPathInfo(conf.BaseDir, path, conf.Suffix)
+}
+
+func (runner runner4) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
+	return splitPathInfo(conf.BaseDir, path, conf.Suffix)
+}
+
 func (w writer) Header() http.Header {
 	return http.Header{}
 }
@@ -173,3 +242,185 @@ func TestRunByStatusCode(t *testing.T) {
 		t.Errorf("status code %s != %s", res, expected)
 	}
 }
+
+func TestRunByTimeout(t *testing.T) {
+	t.Parallel()
+	opts := SrvConfig{}
+	opts.Timeout = time.Duration(1000_000_000)
+	opts.Addr = ":9999"
+	opts.BaseDir = "."
+	runner := runner3{err: fmt.Errorf("%w %v", ErrTimeout, opts.Timeout)}
+	bio := bytes.NewBufferString("")
+	w := writer{
+		out: bio,
+	}
+	u, _ := url.Parse("http://hello.world.example.com/exec_if_test.go/hello/world?a=b&c=123")
+	r := http.Request{
+		Method:     http.MethodGet,
+		RemoteAddr: "127.0.0.1:9999",
+		URL:        u,
+		Proto:      "tcp",
+		RequestURI: "/exec_if_test.go",
+	}
+	err := RunBy(opts, runner, w, &r)
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	res := w.out.String()
+	expected := "status code = 504\ncommand error: timeout 1s"
+	if res != expected {
+		t.Errorf("status code %s != %s", res, expected)
+	}
+}
+
+func TestRunByCancel(t *testing.T) {
+	t.Parallel()
+	opts := SrvConfig{}
+	opts.Timeout = time.Duration(1000_000_000)
+	opts.Addr = ":9999"
+	opts.BaseDir = "."
+	runner := runner3{err: context.Canceled}
+	bio := bytes.NewBufferString("")
+	w := writer{
+		out: bio,
+	}
+	u, _ := url.Parse("http://hello.world.example.com/exec_if_test.go/hello/world?a=b&c=123")
+	r := http.Request{
+		Method:     http.MethodGet,
+		RemoteAddr: "127.0.0.1:9999",
+		URL:        u,
+		Proto:      "tcp",
+		RequestURI: "/exec_if_test.go",
+	}
+	err := RunBy(opts, runner, w, &r)
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	res := w.out.String()
+	expected := "status code = 499\ncommand error: context canceled"
+	if res != expected {
+		t.Errorf("status code %s != %s", res, expected)
+	}
+}
+
+func TestRunByScratchDir(t *testing.T) {
+	t.Parallel()
+	opts := SrvConfig{}
+	opts.Timeout = time.Duration(1000_000_000)
+	opts.Addr = ":9999"
+	opts.BaseDir = "."
+	opts.ScratchDir = t.TempDir()
+	var tmpdir string
+	runner := runner4{tmpdir: &tmpdir}
+	bio := bytes.NewBufferString("")
+	w := writer{
+		out: bio,
+	}
+	u, _ := url.Parse("http://hello.world.example.com/exec_if_test.go")
+	r := http.Request{
+		Method:     http.MethodGet,
+		RemoteAddr: "127.0.0.1:9999",
+		URL:        u,
+		Proto:      "tcp",
+		RequestURI: "/exec_if_test.go",
+	}
+	err := RunBy(opts, runner, w, &r)
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	res := w.out.String()
+	expected := "status code = 200\n"
+	if res != expected {
+		t.Errorf("status code %s != %s", res, expected)
+	}
+	if filepath.Dir(tmpdir) != opts.ScratchDir {
+		t.Error("tmpdir", tmpdir)
+	}
+	if _, err := os.Stat(tmpdir); !os.IsNotExist(err) {
+		t.Error("not removed", err)
+	}
+}
+
+func TestRunByExitCode(t *testing.T) {
+	t.Parallel()
+	opts := SrvConfig{}
+	opts.Addr = ":9999"
+	opts.BaseDir = "."
+	runner := runner3{err: ExitCodeError{Code: 3}}
+	bio := bytes.NewBufferString("")
+	w := writer{
+		out: bio,
+	}
+	u, _ := url.Parse("http://hello.world.example.com/exec_if_test.go/hello/world?a=b&c=123")
+	r := http.Request{
+		Method:     http.MethodGet,
+		RemoteAddr: "127.0.0.1:9999",
+		URL:        u,
+		Proto:      "tcp",
+		RequestURI: "/exec_if_test.go",
+	}
+	err := RunBy(opts, runner, w, &r)
+	if err != nil {
+		t.Errorf("error: %s", err)
+	}
+	res := w.out.String()
+	expected := "status code = 502\ncommand error: exit status 3"
+	if res != expected {
+		t.Errorf("status code %s != %s", res, expected)
+	}
+}
+
+func TestRunByAccessLog(t *testing.T) {
+	// replaces default logger. not parallel
+	buf := &bytes.Buffer{}
+	orig := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(buf, nil)))
+	defer slog.SetDefault(orig)
+	opts := SrvConfig{}
+	opts.Addr = ":9999"
+	opts.BaseDir = "."
+	runner := runner6{err: ExitCodeError{Code: 3}}
+	r := httptest.NewRequest(http.MethodGet, "/exec_if_test.go", nil)
+	w := httptest.NewRecorder()
+	if err := RunBy(opts, runner, w, r); err != nil {
+		t.Error("error", err)
+	}
+	if w.Code != 201 {
+		t.Error("code", w.Code)
+	}
+	var entry struct {
+		Msg    string
+		Status int
+		Error  string
+	}
+	for line := range strings.Lines(buf.String()) {
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Error("unmarshal", err, line)
+		}
+		if entry.Msg == "access-log" {
+			break
+		}
+	}
+	// sent status and the failure
+	if entry.Msg != "access-log" || entry.Status != 201 || entry.Error != "exit status 3" {
+		t.Error("access-log", entry)
+	}
+}
+
+func TestRunByEnv(t *testing.T) {
+	t.Parallel()
+	opts := SrvConfig{}
+	opts.Addr = ":9999"
+	opts.BaseDir = "."
+	opts.Env = []string{"HTTP_X_API_KEY=configured", "APP_MODE=test"}
+	runner := &runner5{}
+	r := httptest.NewRequest(http.MethodGet, "/exec_if_test.go", nil)
+	r.Header.Set("X-Api-Key", "from-client")
+	r.Header.Set("X-Other", "other")
+	if err := RunBy(opts, runner, httptest.NewRecorder(), r); err != nil {
+		t.Error("runby", err)
+	}
+	if runner.env["HTTP_X_API_KEY"] != "configured" || runner.env["APP_MODE"] != "test" || runner.env["HTTP_X_OTHER"] != "other" {
+		t.Error("env", runner.env)
+	}
+}
@@ -2,12 +2,15 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"os/exec"
 	"path/filepath"
 	"sync"
+	"syscall"
+	"time"
 )
 
 // OsRunner is normal CGI executor
@@ -31,12 +34,28 @@ func (runner *OsRunner) getPipe(cmd *exec.Cmd) (
 	return
 }
 
+// terminate sends SIGTERM to the process group, and SIGKILL after grace period
+func (runner *OsRunner) terminate(cmd *exec.Cmd, wg *sync.WaitGroup, grace time.Duration) {
+	if err := signalGroup(cmd, syscall.SIGTERM); err != nil {
+		slog.Error("sigterm failed", "error", err)
+	}
+	if grace > 0 && timeoutWait(context.Background(), wg, grace) == nil {
+		slog.Debug("terminated", "pid", cmd.Process.Pid)
+	}
+	// kill remaining processes in the group even if stdout/stderr are closed
+	if err := signalGroup(cmd, syscall.SIGKILL); err != nil && !errors.Is(err, syscall.ESRCH) {
+		slog.Error("kill failed", "error", err)
+	}
+}
+
 // Run implements Runner.Run
 func (runner *OsRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
 	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
 	fn := filepath.Join(conf.BaseDir, cmdname)
 	slog.Debug("path", "full-path", fn)
 	cmd := exec.Command(fn)
+	cmd.Dir = workDir(conf, cmdname)
+	setProcessGroup(cmd)
 	slog.Debug("pid", "process", cmd.Process)
 	cmdStdin, cmdStdout, cmdStderr, err := runner.getPipe(cmd)
 	if err != nil {
@@ -50,7 +69,7 @@ func (runner *OsRunner) Run(conf SrvConfig, cmdname string, envvar map[string]st
 		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", k, v))
 	}
 	slog.Debug("starting command", "cmd", cmd)
-	if err := cmd.Start(); err != nil {
+	if err := reaper.Start(cmd); err != nil {
 		return err
 	}
 	slog.Debug("pid", "process", cmd.Process)
@@ -58,6 +77,7 @@ func (runner *OsRunner) Run(conf SrvConfig, cmdname string, envvar map[string]st
 		if err := cmd.Wait(); err != nil {
 			slog.Error("wait", "error", err)
 		}
+		reaper.Release(cmd)
 	}()
 	var wg sync.WaitGroup
 	wg.Go(func() {
@@ -75,12 +95,11 @@ func (runner *OsRunner) Run(conf SrvConfig, cmdname string, envvar map[string]st
 			slog.Error("stdout", "error", err)
 		}
 	})
-	if timeoutWait(&wg, conf.Timeout) {
-		slog.Warn("timeout")
-		if err := cmd.Process.Kill(); err != nil {
-			slog.Error("kill failed", "error", err)
-		}
-		return fmt.Errorf("timeout %v", conf.Timeout)
+	// total timeout is applied to ctx by RunBy
+	if err := timeoutWait(ctx, &wg, 0); err != nil {
+		slog.Warn("abort", "pid", cmd.Process.Pid, "error", err)
+		runner.terminate(cmd, &wg, conf.KillGrace)
+		return err
 	}
 	return nil
 }
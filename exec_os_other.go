@@ -0,0 +1,20 @@
+//go:build !unix
+
+package main
+
+import (
+	"os/exec"
+	"syscall"
+)
+
+// setProcessGroup is not supported on this platform
+func setProcessGroup(cmd *exec.Cmd) {
+}
+
+// signalGroup sends signal to the command only
+func signalGroup(cmd *exec.Cmd, sig syscall.Signal) error {
+	if sig == syscall.SIGKILL {
+		return cmd.Process.Kill()
+	}
+	return cmd.Process.Signal(sig)
+}
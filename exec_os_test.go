@@ -3,9 +3,14 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 )
@@ -90,7 +95,9 @@ func TestOsRunTimeout(t *testing.T) {
 	}
 	defer os.RemoveAll(tmpd)
 	conf.BaseDir = tmpd
-	ctx := context.Background()
+	// applied by RunBy
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 200*time.Millisecond, fmt.Errorf("%w 200ms", ErrTimeout))
+	defer cancel()
 	if err = os.WriteFile(filepath.Join(tmpd, "cmd1"), []byte("#! /bin/sh\nsleep 10"), 0755); err != nil {
 		t.Error("writefile", err)
 	}
@@ -99,7 +106,98 @@ func TestOsRunTimeout(t *testing.T) {
 	stdout := &bytes.Buffer{}
 	stderr := &bytes.Buffer{}
 	err = runner.Run(conf, "cmd1", env, stdin, stdout, stderr, ctx)
-	if err == nil {
-		t.Error("no timeout ?")
+	if !errors.Is(err, ErrTimeout) {
+		t.Error("no timeout ?", err)
+	}
+}
+
+func TestOsRunNoTimeout(t *testing.T) {
+	t.Parallel()
+	opts := SrvConfig{}
+	opts.Addr = ":9999"
+	opts.BaseDir = t.TempDir()
+	// timeout 0 is unlimited
+	opts.Timeout = 0
+	if err := os.WriteFile(filepath.Join(opts.BaseDir, "cmd1"), []byte("#! /bin/sh\nsleep 0.2\necho\necho ok"), 0755); err != nil {
+		t.Fatal("writefile", err)
+	}
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/cmd1", nil)
+	if err := RunBy(opts, &OsRunner{}, w, r); err != nil {
+		t.Error("runby", err)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "ok\n" {
+		t.Error("response", w.Code, w.Body.String())
+	}
+}
+
+func TestOsRunCancel(t *testing.T) {
+	t.Parallel()
+	runner := OsRunner{}
+	conf := SrvConfig{}
+	conf.Timeout = time.Duration(10_000_000_000)
+	tmpd, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Error("tmpdir", err)
+	}
+	defer os.RemoveAll(tmpd)
+	conf.BaseDir = tmpd
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if err = os.WriteFile(filepath.Join(tmpd, "cmd1"), []byte("#! /bin/sh\nsleep 10"), 0755); err != nil {
+		t.Error("writefile", err)
+	}
+	env := map[string]string{}
+	stdin := io.NopCloser(&bytes.Buffer{})
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	start := time.Now()
+	err = runner.Run(conf, "cmd1", env, stdin, stdout, stderr, ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Error("not cancelled", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Error("too late", time.Since(start))
+	}
+}
+
+func TestOsRunWorkDir(t *testing.T) {
+	t.Parallel()
+	runner := OsRunner{}
+	tmpd, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Error("tmpdir", err)
+	}
+	defer os.RemoveAll(tmpd)
+	tmpd, err = filepath.EvalSymlinks(tmpd)
+	if err != nil {
+		t.Error("symlink", err)
+	}
+	if err = os.Mkdir(filepath.Join(tmpd, "sub"), 0755); err != nil {
+		t.Error("mkdir", err)
+	}
+	if err = os.WriteFile(filepath.Join(tmpd, "sub", "cmd1"), []byte("#! /bin/sh\npwd"), 0755); err != nil {
+		t.Error("writefile", err)
+	}
+	expected := map[string]string{
+		"script": filepath.Join(tmpd, "sub"),
+		"base":   tmpd,
+		"/":      "/",
+	}
+	for wd, dir := range expected {
+		conf := SrvConfig{}
+		conf.Timeout = time.Duration(1000_000_000)
+		conf.BaseDir = tmpd
+		conf.WorkDir = wd
+		env := map[string]string{}
+		stdin := io.NopCloser(&bytes.Buffer{})
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		if err = runner.Run(conf, "sub/cmd1", env, stdin, stdout, stderr, context.Background()); err != nil {
+			t.Error("error", err)
+		}
+		if strings.TrimSpace(stdout.String()) != dir {
+			t.Error("workdir", wd, stdout.String())
+		}
 	}
 }
@@ -0,0 +1,64 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestOsRunTimeoutKillGroup(t *testing.T) {
+	t.Parallel()
+	runner := OsRunner{}
+	conf := SrvConfig{}
+	conf.KillGrace = time.Duration(100_000_000)
+	tmpd, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Error("tmpdir", err)
+	}
+	defer os.RemoveAll(tmpd)
+	conf.BaseDir = tmpd
+	// applied by RunBy
+	ctx, cancel := context.WithTimeoutCause(context.Background(), 200*time.Millisecond, fmt.Errorf("%w 200ms", ErrTimeout))
+	defer cancel()
+	pidfile := filepath.Join(tmpd, "pid")
+	script := "#! /bin/sh\nsleep 10 &\necho $! > " + pidfile + "\nwait\n"
+	if err = os.WriteFile(filepath.Join(tmpd, "cmd1"), []byte(script), 0755); err != nil {
+		t.Error("writefile", err)
+	}
+	env := map[string]string{}
+	stdin := io.NopCloser(&bytes.Buffer{})
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	err = runner.Run(conf, "cmd1", env, stdin, stdout, stderr, ctx)
+	if !errors.Is(err, ErrTimeout) {
+		t.Error("not timeout", err)
+	}
+	pidstr, err := os.ReadFile(pidfile)
+	if err != nil {
+		t.Fatal("readfile", err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(pidstr)))
+	if err != nil {
+		t.Fatal("pid", err)
+	}
+	for range 50 {
+		stat, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(pid), "stat"))
+		if err != nil || strings.Contains(string(stat), ") Z ") {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	syscall.Kill(pid, syscall.SIGKILL)
+	t.Error("child process still alive", pid)
+}
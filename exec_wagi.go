@@ -0,0 +1,330 @@
+//go:build wazero
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/tetratelabs/wazero"
+)
+
+// wagiDefaultArgv is argv of the module when not configured
+const wagiDefaultArgv = "${SCRIPT_NAME} ${ARGS}"
+
+// wagiModule is a [[module]] entry of modules.toml
+type wagiModule struct {
+	Route        string            `toml:"route"`
+	Module       string            `toml:"module"`
+	Entrypoint   string            `toml:"entrypoint"`
+	Volumes      map[string]string `toml:"volumes"` // guest path to host path
+	Environment  map[string]string `toml:"environment"`
+	AllowedHosts []string          `toml:"allowed_hosts"`
+	Argv         string            `toml:"argv"`
+	allow        []wasmHTTPAllow   // parsed AllowedHosts
+}
+
+type wagiConfig struct {
+	Module []wagiModule `toml:"module"`
+}
+
+// base returns route without wildcard suffix
+func (m wagiModule) base() string {
+	return strings.TrimSuffix(m.Route, "/...")
+}
+
+func (m wagiModule) wildcard() bool {
+	return strings.HasSuffix(m.Route, "/...")
+}
+
+// WagiRunner implements CGI Runner execute WAGI modules by wazero
+type WagiRunner struct {
+	wazero   *WazeroRunner
+	routes   map[string]wagiModule
+	wildcard []wagiModule // longest first
+}
+
+// newWagiRunner returns WagiRunner with routes read from modules.toml
+func newWagiRunner(conf SrvConfig) (*WagiRunner, error) {
+	if conf.WagiConfig == "" {
+		return nil, errors.New("--wagi-config is required")
+	}
+	modules, err := loadWagiConfig(conf.WagiConfig)
+	if err != nil {
+		return nil, err
+	}
+	wz, err := newWazeroRunner(conf)
+	if err != nil {
+		return nil, err
+	}
+	runner := &WagiRunner{wazero: wz, routes: map[string]wagiModule{}}
+	for _, m := range modules {
+		if err := runner.addRoute(m); err != nil {
+			return nil, err
+		}
+		subroutes, err := runner.subRoutes(conf, m)
+		if err != nil {
+			slog.Error("_routes", "error", err, "module", m.Module)
+			return nil, err
+		}
+		for _, sub := range subroutes {
+			if err := runner.addRoute(sub); err != nil {
+				return nil, err
+			}
+		}
+	}
+	slices.SortStableFunc(runner.wildcard, func(a, b wagiModule) int {
+		return len(b.Route) - len(a.Route)
+	})
+	slog.Info("wagi routes loaded", "filename", conf.WagiConfig, "routes", len(runner.routes))
+	return runner, nil
+}
+
+// loadWagiConfig reads modules.toml. relative paths are resolved from the directory of the file
+func loadWagiConfig(filename string) ([]wagiModule, error) {
+	var cfg wagiConfig
+	md, err := toml.DecodeFile(filename, &cfg)
+	if err != nil {
+		slog.Error("parse wagi config", "error", err, "filename", filename)
+		return nil, err
+	}
+	for _, key := range md.Undecoded() {
+		slog.Warn("ignored wagi config", "key", key.String(), "filename", filename)
+	}
+	dir := filepath.Dir(filename)
+	abs := func(p string) string {
+		if filepath.IsAbs(p) {
+			return p
+		}
+		return filepath.Join(dir, p)
+	}
+	for i, m := range cfg.Module {
+		if m.Route == "" || !strings.HasPrefix(m.Route, "/") {
+			return nil, fmt.Errorf("invalid route %q of module %s", m.Route, m.Module)
+		}
+		if m.Module == "" {
+			return nil, fmt.Errorf("no module for route %s", m.Route)
+		}
+		m.Module = abs(m.Module)
+		if m.Entrypoint == "" {
+			m.Entrypoint = "_start"
+		}
+		if m.Argv == "" {
+			m.Argv = wagiDefaultArgv
+		}
+		for guest, host := range m.Volumes {
+			m.Volumes[guest] = abs(host)
+		}
+		for _, h := range m.AllowedHosts {
+			var a wasmHTTPAllow
+			if err := a.UnmarshalFlag(h); err != nil {
+				return nil, fmt.Errorf("route %s: %w", m.Route, err)
+			}
+			m.allow = append(m.allow, a)
+		}
+		cfg.Module[i] = m
+	}
+	return cfg.Module, nil
+}
+
+func (runner *WagiRunner) addRoute(m wagiModule) error {
+	if _, ok := runner.routes[m.Route]; ok {
+		return fmt.Errorf("duplicate route %s", m.Route)
+	}
+	slog.Debug("wagi route", "route", m.Route, "module", m.Module, "entrypoint", m.Entrypoint)
+	runner.routes[m.Route] = m
+	if m.wildcard() {
+		runner.wildcard = append(runner.wildcard, m)
+	}
+	return nil
+}
+
+// subRoutes calls _routes export of the module. each line of the output is "route entrypoint"
+func (runner *WagiRunner) subRoutes(conf SrvConfig, m wagiModule) ([]wagiModule, error) {
+	code, err := runner.wazero.cache.get(m.Module, memoryPages(conf))
+	if err != nil {
+		return nil, err
+	}
+	if _, ok := code.ExportedFunctions()["_routes"]; !ok {
+		return nil, nil
+	}
+	ctx, cancel := wasmDeadline(conf, context.Background())
+	defer cancel()
+	stdout := bytes.Buffer{}
+	wconf := wazero.NewModuleConfig().
+		WithName("").
+		WithStdout(&stdout).
+		WithStderr(newLogWriter("module", m.Module)).
+		WithStartFunctions("_initialize")
+	if err := runner.call(ctx, code, wconf, "_routes"); err != nil {
+		return nil, err
+	}
+	res := []wagiModule{}
+	scanner := bufio.NewScanner(&stdout)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		switch len(fields) {
+		case 0:
+			continue
+		case 2:
+		default:
+			return nil, fmt.Errorf("invalid route line %q", scanner.Text())
+		}
+		sub := m
+		sub.Route = m.base() + "/" + strings.TrimPrefix(fields[0], "/")
+		sub.Entrypoint = fields[1]
+		res = append(res, sub)
+	}
+	return res, nil
+}
+
+// call instantiates the module and calls entrypoint
+func (runner *WagiRunner) call(ctx context.Context, code wazero.CompiledModule, wconf wazero.ModuleConfig, entrypoint string) error {
+	if _, ok := code.ExportedFunctions()[entrypoint]; !ok {
+		return fmt.Errorf("entrypoint %s not found", entrypoint)
+	}
+	if entrypoint == "_start" {
+		wconf = wconf.WithStartFunctions("_start")
+	}
+	mod, err := runner.wazero.rt.InstantiateModule(ctx, code, wconf)
+	if mod != nil {
+		defer mod.Close(context.WithoutCancel(ctx))
+	}
+	if err == nil && entrypoint != "_start" {
+		_, err = mod.ExportedFunction(entrypoint).Call(ctx)
+	}
+	if ctx.Err() != nil {
+		slog.Warn("cancelled", "error", err)
+		return context.Cause(ctx)
+	}
+	return wazeroResult(ctx, err)
+}
+
+// wagiArgs expands argv template. ${ARGS} is replaced with the query parameters
+func wagiArgs(argv string, envvar map[string]string) []string {
+	args := []string{}
+	for q := range strings.SplitSeq(envvar["QUERY_STRING"], "&") {
+		if q == "" {
+			continue
+		}
+		if v, err := url.QueryUnescape(q); err == nil {
+			q = v
+		}
+		args = append(args, q)
+	}
+	res := []string{}
+	for _, f := range strings.Fields(argv) {
+		if f == "${ARGS}" || f == "$ARGS" {
+			res = append(res, args...)
+			continue
+		}
+		res = append(res, os.Expand(f, func(k string) string { return envvar[k] }))
+	}
+	return res
+}
+
+// wagiPreopens returns volumes of the module, scratch dir and configured preopens
+func wagiPreopens(conf SrvConfig, m wagiModule, ctx context.Context) []wasmPreopen {
+	res := []wasmPreopen{}
+	for guest, host := range m.Volumes {
+		res = append(res, wasmPreopen{Host: host, Guest: guest})
+	}
+	if dir := scratchDir(ctx); dir != "" {
+		res = append(res, wasmPreopen{Host: dir, Guest: "/tmp"})
+	}
+	for _, p := range conf.WasmPreopen {
+		res = slices.DeleteFunc(res, func(q wasmPreopen) bool { return q.Guest == p.Guest })
+		res = append(res, p)
+	}
+	return res
+}
+
+func (runner *WagiRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
+	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer,
+	ctx context.Context) error {
+	m, ok := runner.routes[cmdname]
+	if !ok {
+		return fmt.Errorf("route not found %s", cmdname)
+	}
+	ctx, cancel := wasmDeadline(conf, ctx)
+	defer cancel()
+	code, err := runner.wazero.module(conf, m.Module)
+	if err != nil {
+		return err
+	}
+	conf.WasmHTTPAllow = append(slices.Clip(conf.WasmHTTPAllow), m.allow...)
+	if ctx, err = runner.wazero.withWasmHost(conf, m.Route, ctx); err != nil {
+		return err
+	}
+	ctx, finish := runner.wazero.startProfile(conf, m.Route, ctx)
+	defer finish()
+	env := wasmEnv(envvar, ctx)
+	env["SCRIPT_NAME"] = m.base()
+	env["X_MATCHED_ROUTE"] = m.Route
+	env["X_RAW_PATH_INFO"] = envvar["PATH_INFO"]
+	env["X_RELATIVE_PATH"] = strings.TrimPrefix(envvar["PATH_INFO"], "/")
+	// CGI meta-variables take precedence
+	for k, v := range m.Environment {
+		if _, ok := env[k]; !ok {
+			env[k] = v
+		}
+	}
+	wconf := wazero.NewModuleConfig().
+		WithName("").
+		WithStdout(stdout).
+		WithStderr(stderr).
+		WithStdin(stdin).
+		WithArgs(wagiArgs(m.Argv, env)...).
+		// initialize reactor modules before calling the entrypoint
+		WithStartFunctions("_initialize")
+	for k, v := range env {
+		wconf = wconf.WithEnv(k, v)
+	}
+	fsconf := wazero.NewFSConfig()
+	for _, p := range wagiPreopens(conf, m, ctx) {
+		if p.ReadOnly {
+			fsconf = fsconf.WithReadOnlyDirMount(p.Host, p.Guest)
+		} else {
+			fsconf = fsconf.WithDirMount(p.Host, p.Guest)
+		}
+	}
+	wconf = wconf.WithFSConfig(fsconf)
+	return runner.call(ctx, code, wconf, m.Entrypoint)
+}
+
+// Exists returns matched route and path info. exact routes are preferred, then the longest wildcard
+func (runner *WagiRunner) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
+	p := "/" + strings.TrimPrefix(path, "/")
+	if m, ok := runner.routes[p]; ok && !m.wildcard() {
+		return p, "", nil
+	}
+	for _, m := range runner.wildcard {
+		base := m.base()
+		if p == base || strings.HasPrefix(p, base+"/") {
+			return m.Route, p[len(base):], nil
+		}
+	}
+	slog.Warn("not found", "path", path)
+	return "", "", fmt.Errorf("not found %s", path)
+}
+
+func init() {
+	runnerMap["wagi"] = func(conf SrvConfig) Runner {
+		runner, err := newWagiRunner(conf)
+		if err != nil {
+			panic(fmt.Sprintf("wagi error: %s", err))
+		}
+		return runner
+	}
+}
@@ -0,0 +1,232 @@
+//go:build wazero
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// wagiSrc is a reactor module declaring sub-routes
+const wagiSrc = `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+//go:wasmexport _routes
+func routes() {
+	fmt.Println("/hello hello")
+	fmt.Println("/files/... files")
+}
+
+//go:wasmexport hello
+func hello() {
+	fmt.Print("Content-Type: text/plain\n\n")
+	fmt.Print(os.Getenv("SCRIPT_NAME"), " ", os.Getenv("X_MATCHED_ROUTE"), " ", os.Getenv("GREETING"))
+}
+
+//go:wasmexport files
+func files() {
+	fmt.Print("Content-Type: text/plain\n\n")
+	data, err := os.ReadFile("/data/" + os.Getenv("X_RELATIVE_PATH"))
+	if err != nil {
+		fmt.Print("error ", err)
+		return
+	}
+	fmt.Print(string(data))
+}
+
+func main() {}
+`
+
+// wagiArgsSrc is a command module printing arguments
+const wagiArgsSrc = `package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+func main() {
+	fmt.Print("Content-Type: text/plain\n\n")
+	fmt.Print(strings.Join(os.Args, ","))
+	if len(os.Args) > 2 && os.Args[2] == "fail" {
+		os.Exit(3)
+	}
+}
+`
+
+const wagiToml = `
+[[module]]
+route = "/app/..."
+module = "app.wasm"
+environment = { GREETING = "hi" }
+volumes = { "/data" = "data" }
+
+[[module]]
+route = "/args"
+module = "args.wasm"
+argv = "${SCRIPT_NAME} x ${ARGS}"
+`
+
+func newTestWagiRunner(t *testing.T) (*WagiRunner, SrvConfig) {
+	dir := t.TempDir()
+	buildWasm(t, filepath.Join(dir, "app.wasm"), wagiSrc, "-buildmode=c-shared")
+	buildWasm(t, filepath.Join(dir, "args.wasm"), wagiArgsSrc)
+	if err := os.Mkdir(filepath.Join(dir, "data"), 0755); err != nil {
+		t.Fatal("mkdir", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "data", "a.txt"), []byte("data a"), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "modules.toml"), []byte(wagiToml), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	conf := SrvConfig{}
+	conf.Timeout = 10 * time.Second
+	conf.WasmCacheSize = 4
+	conf.WagiConfig = filepath.Join(dir, "modules.toml")
+	runner, err := newWagiRunner(conf)
+	if err != nil {
+		t.Fatal("runner", err)
+	}
+	return runner, conf
+}
+
+func TestWagi(t *testing.T) {
+	t.Parallel()
+	runner, conf := newTestWagiRunner(t)
+	run := func(path, query string) (string, error) {
+		script, pathinfo, err := runner.Exists(conf, path, context.Background())
+		if err != nil {
+			return "", err
+		}
+		env := map[string]string{"SCRIPT_NAME": script, "PATH_INFO": pathinfo, "QUERY_STRING": query}
+		stdin := io.NopCloser(bytes.NewBufferString(""))
+		stdout := &bytes.Buffer{}
+		err = runner.Run(conf, script, env, stdin, stdout, &bytes.Buffer{}, context.Background())
+		return stdout.String(), err
+	}
+	tests := []struct {
+		path  string
+		query string
+		want  string
+	}{
+		{"app/hello", "", "/app/hello /app/hello hi"},
+		{"app/files/a.txt", "", "data a"},
+		{"args", "a=1&b%20c", "/args,x,a=1,b c"},
+	}
+	for _, tt := range tests {
+		out, err := run(tt.path, tt.query)
+		if err != nil {
+			t.Error("run", tt.path, err)
+		}
+		if out != "Content-Type: text/plain\n\n"+tt.want {
+			t.Error("output", tt.path, out)
+		}
+	}
+	if _, err := run("app/other", ""); err == nil {
+		t.Error("app/other has no _start")
+	}
+	if _, err := run("args/sub", ""); err == nil {
+		t.Error("args/sub found")
+	}
+	var exitErr ExitCodeError
+	if _, err := run("args", "fail"); !errors.As(err, &exitErr) || exitErr.Code != 3 {
+		t.Error("exit code", err)
+	}
+}
+
+func TestWagiExists(t *testing.T) {
+	t.Parallel()
+	runner := &WagiRunner{routes: map[string]wagiModule{}}
+	for _, route := range []string{"/", "/a/...", "/a/b/...", "/c", "/..."} {
+		if err := runner.addRoute(wagiModule{Route: route}); err != nil {
+			t.Fatal("add", route, err)
+		}
+	}
+	if err := runner.addRoute(wagiModule{Route: "/c"}); err == nil {
+		t.Error("duplicate route")
+	}
+	slices.SortStableFunc(runner.wildcard, func(a, b wagiModule) int {
+		return len(b.Route) - len(a.Route)
+	})
+	tests := []struct {
+		path, route, pathinfo string
+	}{
+		{"", "/", ""},
+		{"c", "/c", ""},
+		{"a", "/a/...", ""},
+		{"a/x/y", "/a/...", "/x/y"},
+		{"a/b/x", "/a/b/...", "/x"},
+		{"ab", "/...", "/ab"},
+		{"c/d", "/...", "/c/d"},
+	}
+	for _, tt := range tests {
+		route, pathinfo, err := runner.Exists(SrvConfig{}, tt.path, context.Background())
+		if err != nil || route != tt.route || pathinfo != tt.pathinfo {
+			t.Error("exists", tt.path, route, pathinfo, err)
+		}
+	}
+}
+
+func TestWagiArgs(t *testing.T) {
+	t.Parallel()
+	env := map[string]string{"SCRIPT_NAME": "/s", "QUERY_STRING": "x=1&&y%3D2", "FOO": "bar"}
+	if res := wagiArgs(wagiDefaultArgv, env); !slices.Equal(res, []string{"/s", "x=1", "y=2"}) {
+		t.Error("default", res)
+	}
+	if res := wagiArgs("prog --foo=${FOO} $ARGS", env); !slices.Equal(res, []string{"prog", "--foo=bar", "x=1", "y=2"}) {
+		t.Error("template", res)
+	}
+}
+
+func TestLoadWagiConfig(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	filename := filepath.Join(dir, "modules.toml")
+	toml := `
+[[module]]
+route = "/"
+module = "a.wasm"
+volumes = { "/data" = "/srv/data" }
+allowed_hosts = ["https://api.example.com", "GET=http://b.example.com"]
+unknown = 1
+`
+	if err := os.WriteFile(filename, []byte(toml), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	modules, err := loadWagiConfig(filename)
+	if err != nil || len(modules) != 1 {
+		t.Fatal("load", modules, err)
+	}
+	m := modules[0]
+	if m.Module != filepath.Join(dir, "a.wasm") || m.Entrypoint != "_start" || m.Argv != wagiDefaultArgv || m.Volumes["/data"] != "/srv/data" {
+		t.Error("module", m)
+	}
+	if len(m.allow) != 2 || m.allow[0].Origin != "https://api.example.com" || !slices.Equal(m.allow[1].Methods, []string{"GET"}) {
+		t.Error("allowed hosts", m.allow)
+	}
+	for _, invalid := range []string{
+		"[[module]]\nroute = \"/\"\nmodule = \"a.wasm\"\nallowed_hosts = [\"insecure:allow-all\"]\n",
+		"[[module]]\nroute = \"x\"\nmodule = \"a.wasm\"\n",
+		"[[module]]\nroute = \"/\"\n",
+	} {
+		if err := os.WriteFile(filename, []byte(invalid), 0644); err != nil {
+			t.Fatal("writefile", err)
+		}
+		if _, err := loadWagiConfig(filename); err == nil {
+			t.Error("invalid", invalid)
+		}
+	}
+}
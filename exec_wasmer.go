@@ -4,111 +4,160 @@ package main
 
 import (
 	"context"
+	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"os"
+	"os/exec"
 	"path/filepath"
-	"sync"
+	"syscall"
 
 	"github.com/wasmerio/wasmer-go/wasmer"
 )
 
 // WasmerRunner implements CGI Runner execute by wasmer
 type WasmerRunner struct {
+	engine *wasmer.Engine
+	cache  *moduleCache[[]byte] // serialized compiled modules
 }
 
-func (runner *WasmerRunner) pipeStdout(wasiEnv *wasmer.WasiEnvironment, output io.Writer) error {
-	data := wasiEnv.ReadStdout()
-	slog.Info("stdout", "length", len(data))
-	dlen, err := output.Write(data)
-	if err != nil {
-		slog.Error("output", "error", err)
+// newWasmerRunner returns WasmerRunner with shared engine
+func newWasmerRunner(conf SrvConfig) *WasmerRunner {
+	engine := wasmer.NewEngine()
+	compile := func(bytecode []byte) ([]byte, error) {
+		store := wasmer.NewStore(engine)
+		defer store.Close()
+		module, err := wasmer.NewModule(store, bytecode)
+		if err != nil {
+			return nil, err
+		}
+		defer module.Close()
+		return module.Serialize()
+	}
+	valid := func(compiled []byte) error {
+		store := wasmer.NewStore(engine)
+		defer store.Close()
+		module, err := wasmer.DeserializeModule(store, compiled)
+		if err == nil {
+			module.Close()
+		}
 		return err
 	}
-	slog.Debug("output", "length", dlen)
-	return nil
+	compile = artifactCache(conf.WasmCacheDir, "wasmer", compile, valid)
+	return &WasmerRunner{
+		engine: engine,
+		cache:  newModuleCache(conf.WasmCacheSize, compile, nil),
+	}
 }
 
-func (runner *WasmerRunner) pipeStderr(wasiEnv *wasmer.WasiEnvironment, output io.Writer) error {
-	data := wasiEnv.ReadStderr()
-	slog.Info("stderr", "length", len(data))
-	dlen, err := output.Write(data)
-	if err != nil {
-		slog.Error("output(err)", "error", err)
-		return err
+// Compile implements Compiler. the artifact is saved in conf.WasmCacheDir
+func (runner *WasmerRunner) Compile(conf SrvConfig, cmdname string) error {
+	if conf.WasmCacheDir == "" {
+		return errors.New("--wasm-cache-dir is required")
 	}
-	slog.Debug("output(err)", "length", dlen)
-	return nil
+	_, err := runner.cache.get(filepath.Join(conf.BaseDir, cmdname), memoryPages(conf))
+	return err
 }
 
-// Run implements Runner.Run
+// Run implements Runner.Run. the module runs in a child process, killed when ctx is done
 func (runner *WasmerRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
 	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
-	fn := filepath.Join(conf.BaseDir, cmdname)
-	bytecode, err := os.ReadFile(fn)
+	ctx, cancel := wasmDeadline(conf, ctx)
+	defer cancel()
+	compiled, err := runner.cache.get(filepath.Join(conf.BaseDir, cmdname), memoryPages(conf))
 	if err != nil {
-		slog.Error("read bytecode", "error", err, "filename", fn)
 		return err
 	}
-	slog.Debug("bytecode read", "length", len(bytecode), "filename", fn)
-	bld := wasmer.NewWasiStateBuilder(cmdname)
-	for k, v := range envvar {
-		bld = bld.Environment(k, v)
+	preopens := wasmPreopens(conf, cmdname, ctx)
+	// wasmer-go has no permission of mapped directory. rejected at startup by checkPreopens
+	if err := writablePreopens(preopens, "wasmer"); err != nil {
+		return err
 	}
-	wasiEnv, err := bld.MapDirectory(conf.BaseDir, ".").CaptureStdout().CaptureStderr().Finalize()
+	req := wasmerChildRequest{Name: cmdname, Module: compiled, Env: wasmEnv(envvar, ctx), Preopens: preopens}
+	exe, err := os.Executable()
 	if err != nil {
-		slog.Error("build wasi", "error", err)
 		return err
 	}
-	engine := wasmer.NewEngine()
-	store := wasmer.NewStore(engine)
-	module, err := wasmer.NewModule(store, bytecode)
+	reqR, reqW, err := os.Pipe()
 	if err != nil {
-		slog.Error("wasmer module", "error", err)
 		return err
 	}
-	slog.Debug("wasi", "version", wasmer.GetWasiVersion(module).String())
-	importObj, err := wasiEnv.GenerateImportObject(store, module)
+	defer reqW.Close()
+	resR, resW, err := os.Pipe()
 	if err != nil {
-		slog.Error("import object", "error", err)
+		reqR.Close()
 		return err
 	}
-	instance, err := wasmer.NewInstance(module, importObj)
+	defer resR.Close()
+	// not cmd.Stdin = stdin: Wait would wait for the request body after the child exits
+	inR, inW, err := os.Pipe()
 	if err != nil {
-		slog.Error("new instance", "error", err)
+		reqR.Close()
+		resW.Close()
 		return err
 	}
-	start, err := instance.Exports.GetWasiStartFunction()
-	if err != nil {
-		slog.Error("wasi start", "error", err)
+	defer inW.Close()
+	cmd := exec.CommandContext(ctx, exe)
+	cmd.Env = []string{wasmerChildEnv + "=1"}
+	cmd.Stdin = inR
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	cmd.ExtraFiles = []*os.File{reqR, resW}
+	setProcessGroup(cmd)
+	cmd.Cancel = func() error {
+		return signalGroup(cmd, syscall.SIGKILL)
 	}
-	slog.Debug("run wasi")
-	res, err := start()
+	err = reaper.Start(cmd)
+	reqR.Close()
+	resW.Close()
+	inR.Close()
 	if err != nil {
-		slog.Error("wasi function returns error", "error", err)
+		slog.Error("wasmer child", "error", err)
 		return err
 	}
-	var wg sync.WaitGroup
-	wg.Go(func() { runner.pipeStdout(wasiEnv, stdout) })
-	wg.Go(func() { runner.pipeStderr(wasiEnv, stderr) })
-	if timeoutWait(&wg, conf.Timeout) {
-		slog.Warn("timeout")
-		return nil
+	go func() {
+		if _, err := io.Copy(inW, stdin); err != nil && !errors.Is(err, os.ErrClosed) && !errors.Is(err, syscall.EPIPE) {
+			slog.Error("write stdin", "error", err)
+		}
+		inW.Close()
+	}()
+	go func() {
+		if err := gob.NewEncoder(reqW).Encode(req); err != nil {
+			slog.Error("wasmer request", "error", err)
+		}
+		reqW.Close()
+	}()
+	var res wasmerChildResult
+	// EOF if the child is killed
+	rerr := gob.NewDecoder(resR).Decode(&res)
+	werr := cmd.Wait()
+	reaper.Release(cmd)
+	if ctx.Err() != nil {
+		slog.Warn("cancelled", "error", context.Cause(ctx), "pid", cmd.Process.Pid)
+		return context.Cause(ctx)
+	}
+	if rerr != nil {
+		slog.Error("wasmer child", "error", rerr, "wait", werr)
+		return fmt.Errorf("wasmer child: %w", errors.Join(rerr, werr))
 	}
-	if res != nil {
-		slog.Debug("wasi success", "res", res)
-	} else {
-		slog.Debug("wasi success(empty)")
+	if res.Error == "" {
+		return wasmResult(ctx, nil, 0, false, "")
 	}
-	return nil
+	return wasmResult(ctx, errors.New(res.Error), res.Code, res.Exited, res.Stack)
 }
 
-func (runner WasmerRunner) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
+func (runner *WasmerRunner) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
 	return splitPathInfo(conf.BaseDir, path, conf.Suffix)
 }
 
 func init() {
-	runnerMap["wasmer"] = func(SrvConfig) Runner {
-		return &WasmerRunner{}
+	runnerMap["wasmer"] = func(conf SrvConfig) Runner {
+		if err := checkPreopens(conf, "wasmer"); err != nil {
+			slog.Error("wasm preopen", "error", err)
+			panic(fmt.Sprintf("wasm preopen error: %s", err))
+		}
+		return newWasmerRunner(conf)
 	}
 }
@@ -0,0 +1,110 @@
+//go:build wasmer
+
+package main
+
+import (
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/wasmerio/wasmer-go/wasmer"
+)
+
+// wasmerChildEnv is set to the process running a module for WasmerRunner.
+// wasmer-go cannot interrupt running module, so the module runs in a child process which is killed on cancellation
+const wasmerChildEnv = "HTTPCGI_WASMER_CHILD"
+
+// wasmerChildRequest is sent to the child process by fd 3
+type wasmerChildRequest struct {
+	Name     string
+	Module   []byte // serialized compiled module
+	Env      map[string]string
+	Preopens []wasmPreopen
+}
+
+// wasmerChildResult is returned from the child process by fd 4
+type wasmerChildResult struct {
+	Error  string // empty if succeeded
+	Code   int
+	Exited bool
+	Stack  string
+}
+
+// run runs the module with stdio of the process
+func (req wasmerChildRequest) run() error {
+	store := wasmer.NewStore(wasmer.NewEngine())
+	module, err := wasmer.DeserializeModule(store, req.Module)
+	if err != nil {
+		return err
+	}
+	bld := wasmer.NewWasiStateBuilder(req.Name)
+	for k, v := range req.Env {
+		bld = bld.Environment(k, v)
+	}
+	for _, p := range req.Preopens {
+		bld = bld.MapDirectory(p.Guest, p.Host)
+	}
+	wasiEnv, err := bld.InheritStdin().InheritStdout().InheritStderr().Finalize()
+	if err != nil {
+		return err
+	}
+	importObj, err := wasiEnv.GenerateImportObject(store, module)
+	if err != nil {
+		return err
+	}
+	instance, err := wasmer.NewInstance(module, importObj)
+	if err != nil {
+		return err
+	}
+	start, err := instance.Exports.GetWasiStartFunction()
+	if err != nil {
+		return err
+	}
+	_, err = start()
+	return err
+}
+
+// wasmerExit converts exit and trap of wasmer. wasmer-go returns exit of WASI as a trap
+func wasmerExit(err error) wasmerChildResult {
+	if err == nil {
+		return wasmerChildResult{}
+	}
+	res := wasmerChildResult{Error: err.Error()}
+	if _, serr := fmt.Sscanf(err.Error(), "WASI exited with code: %d", &res.Code); serr == nil {
+		res.Exited = true
+		return res
+	}
+	stack := []string{}
+	var trap *wasmer.TrapError
+	if errors.As(err, &trap) {
+		for _, f := range trap.Trace() {
+			stack = append(stack, fmt.Sprintf("func[%d]+%#x", f.FunctionIndex(), f.FunctionOffset()))
+		}
+	}
+	res.Stack = strings.Join(stack, "\n")
+	return res
+}
+
+// runWasmerChild runs the module requested by the parent process, and exits
+func runWasmerChild() {
+	var req wasmerChildRequest
+	if err := gob.NewDecoder(os.NewFile(3, "request")).Decode(&req); err != nil {
+		fmt.Fprintln(os.Stderr, "wasmer child: read request:", err)
+		os.Exit(2)
+	}
+	res := wasmerExit(req.run())
+	if err := gob.NewEncoder(os.NewFile(4, "result")).Encode(res); err != nil {
+		fmt.Fprintln(os.Stderr, "wasmer child: write result:", err)
+		os.Exit(2)
+	}
+	os.Exit(0)
+}
+
+func init() {
+	// before parsing flags, also in test binary
+	if os.Getenv(wasmerChildEnv) != "" {
+		runWasmerChild()
+	}
+}
@@ -2,8 +2,112 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
 
 func TestWasmer(t *testing.T) {
-	testWasmAll(t, &WasmerRunner{})
+	testWasmAll(t, newWasmerRunner(SrvConfig{}))
+}
+
+func TestWasmerStream(t *testing.T) {
+	t.Parallel()
+	testWasmStream(t, newWasmerRunner(SrvConfig{}))
+}
+
+func TestWasmerCompile(t *testing.T) {
+	t.Parallel()
+	testWasmCompile(t, func(conf SrvConfig) Runner { return newWasmerRunner(conf) })
+}
+
+// childProcesses lists children of the test process
+func childProcesses(t *testing.T) []string {
+	files, err := filepath.Glob("/proc/self/task/*/children")
+	if err != nil {
+		t.Fatal("glob", err)
+	}
+	res := []string{}
+	for _, fn := range files {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			continue
+		}
+		res = append(res, strings.Fields(string(data))...)
+	}
+	return res
+}
+
+// not parallel, to see children of this test only
+func TestWasmerKill(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("children are listed from /proc")
+	}
+	runner := newWasmerRunner(SrvConfig{})
+	conf := SrvConfig{}
+	conf.Timeout = 10 * time.Second
+	conf.BaseDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(conf.BaseDir, "loop.wasm"), loopWasm, 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(500*time.Millisecond, func() {
+		if len(childProcesses(t)) == 0 {
+			t.Error("no child process")
+		}
+		cancel()
+	})
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	err := runner.Run(conf, "loop.wasm", map[string]string{}, stdin, &bytes.Buffer{}, &bytes.Buffer{}, ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Error("not cancelled", err)
+	}
+	if children := childProcesses(t); len(children) != 0 {
+		t.Error("child process remains", children)
+	}
+}
+
+// not parallel, to see children of this test only
+func TestWasmerDeadline(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("children are listed from /proc")
+	}
+	runner := newWasmerRunner(SrvConfig{})
+	base := SrvConfig{}
+	base.Addr = ":9999"
+	base.BaseDir = t.TempDir()
+	base.Timeout = 10 * time.Second
+	if err := os.WriteFile(filepath.Join(base.BaseDir, "loop.wasm"), loopWasm, 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	timeout := base
+	timeout.Timeout = 300 * time.Millisecond
+	header := base
+	header.HeaderTimeout = 300 * time.Millisecond
+	idle := base
+	idle.IdleTimeout = 300 * time.Millisecond
+	for name, conf := range map[string]SrvConfig{"timeout": timeout, "header": header, "idle": idle} {
+		start := time.Now()
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, "/loop.wasm", nil)
+		if err := RunBy(conf, runner, w, r); err != nil {
+			t.Error("runby", name, err)
+		}
+		if w.Code != http.StatusGatewayTimeout || time.Since(start) > 5*time.Second {
+			t.Error("not timed out", name, w.Code, time.Since(start))
+		}
+		if children := childProcesses(t); len(children) != 0 {
+			t.Error("child process remains", name, children)
+		}
+	}
 }
@@ -4,34 +4,192 @@ package main
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/bytecodealliance/wasmtime-go"
 )
 
 // WasmtimeRunner implements CGI Runner execute by wasmtime
 type WasmtimeRunner struct {
+	cache *moduleCache[*wasmtimeModule]
+}
+
+// wasmtimeIdleEngines is max idle engines per module
+const wasmtimeIdleEngines = 8
+
+// wasmtimeModule is serialized compiled module and idle engines with it deserialized.
+// epoch is per engine and wasmtime-go has no callback to check the deadline of each store,
+// so an engine runs one request at a time to interrupt only it. the engine is reused after the request
+type wasmtimeModule struct {
+	compiled []byte
+	mu       sync.Mutex
+	idle     []*wasmtimeEngine
+}
+
+type wasmtimeEngine struct {
+	engine  *wasmtime.Engine
+	module  *wasmtime.Module
+	fdflags *wasmtime.Module // see blockingStdin
+}
+
+// acquire returns idle engine, or new engine with the module deserialized
+func (m *wasmtimeModule) acquire() (*wasmtimeEngine, error) {
+	m.mu.Lock()
+	if n := len(m.idle); n != 0 {
+		e := m.idle[n-1]
+		m.idle = m.idle[:n-1]
+		m.mu.Unlock()
+		return e, nil
+	}
+	m.mu.Unlock()
+	engine := newWasmtimeEngine()
+	module, err := wasmtime.NewModuleDeserialize(engine, m.compiled)
+	if err != nil {
+		return nil, err
+	}
+	wasm, err := wasmtime.Wat2Wasm(fdflagsWat)
+	if err != nil {
+		return nil, err
+	}
+	fdflags, err := wasmtime.NewModule(engine, wasm)
+	if err != nil {
+		return nil, err
+	}
+	return &wasmtimeEngine{engine: engine, module: module, fdflags: fdflags}, nil
+}
+
+// release returns the engine. epoch must not be incremented after this
+func (m *wasmtimeModule) release(e *wasmtimeEngine) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.idle) < wasmtimeIdleEngines {
+		m.idle = append(m.idle, e)
+	}
+}
+
+// newWasmtimeEngine returns engine interrupted by epoch and fuel.
+// fuel is always consumed: compiled module is not compatible with engine configured otherwise
+func newWasmtimeEngine() *wasmtime.Engine {
+	wtconf := wasmtime.NewConfig()
+	wtconf.SetEpochInterruption(true)
+	wtconf.SetConsumeFuel(true)
+	return wasmtime.NewEngineWithConfig(wtconf)
+}
+
+// newWasmtimeRunner returns WasmtimeRunner
+func newWasmtimeRunner(conf SrvConfig) *WasmtimeRunner {
+	compile := func(bytecode []byte) ([]byte, error) {
+		module, err := wasmtime.NewModule(newWasmtimeEngine(), bytecode)
+		if err != nil {
+			return nil, err
+		}
+		return module.Serialize()
+	}
+	valid := func(compiled []byte) error {
+		_, err := wasmtime.NewModuleDeserialize(newWasmtimeEngine(), compiled)
+		return err
+	}
+	compile = artifactCache(conf.WasmCacheDir, "wasmtime", compile, valid)
+	load := func(bytecode []byte) (*wasmtimeModule, error) {
+		compiled, err := compile(bytecode)
+		if err != nil {
+			return nil, err
+		}
+		return &wasmtimeModule{compiled: compiled}, nil
+	}
+	return &WasmtimeRunner{
+		cache: newModuleCache(conf.WasmCacheSize, load, nil),
+	}
+}
+
+// Compile implements Compiler. the artifact is saved in conf.WasmCacheDir
+func (runner *WasmtimeRunner) Compile(conf SrvConfig, cmdname string) error {
+	if conf.WasmCacheDir == "" {
+		return errors.New("--wasm-cache-dir is required")
+	}
+	_, err := runner.cache.get(filepath.Join(conf.BaseDir, cmdname), memoryPages(conf))
+	return err
+}
+
+// fdflagsWat calls fd_fdstat_set_flags of WASI from wasm, since WASI functions require memory of the caller
+const fdflagsWat = `(module
+  (import "wasi_snapshot_preview1" "fd_fdstat_set_flags" (func $set (param i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (func (export "set") (param i32 i32) (result i32)
+    local.get 0
+    local.get 1
+    call $set))`
+
+// blockingStdin keeps stdin of the module blocking.
+// wasmtime cannot poll FIFO, and Go guests which make stdin non-blocking and poll it abort.
+// other descriptors are passed to fd_fdstat_set_flags of WASI by fdflags module
+func blockingStdin(linker *wasmtime.Linker, store *wasmtime.Store, fdflags *wasmtime.Module) error {
+	inst, err := linker.Instantiate(store, fdflags)
+	if err != nil {
+		return err
+	}
+	setFlags := inst.GetFunc(store, "set")
+	linker.AllowShadowing(true)
+	defer linker.AllowShadowing(false)
+	return linker.FuncWrap("wasi_snapshot_preview1", "fd_fdstat_set_flags", func(caller *wasmtime.Caller, fd int32, flags int32) (int32, *wasmtime.Trap) {
+		if fd == 0 {
+			return 58, nil // notsup
+		}
+		res, err := setFlags.Call(caller, fd, flags)
+		if err != nil {
+			var trap *wasmtime.Trap
+			if errors.As(err, &trap) {
+				return 0, trap
+			}
+			return 0, wasmtime.NewTrap(err.Error())
+		}
+		return res.(int32), nil
+	})
+}
+
+// spoolStdin writes stdin to file in dir for the module.
+// used where FIFO is not available
+func spoolStdin(wasiConfig *wasmtime.WasiConfig, dir string, stdin io.Reader) error {
+	fn := filepath.Join(dir, "stdin")
+	fp, err := os.Create(fn)
+	if err != nil {
+		slog.Error("open stdin", "error", err)
+		return err
+	}
+	_, err = io.Copy(fp, stdin)
+	if cerr := fp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		slog.Error("write stdin", "error", err)
+		return err
+	}
+	return wasiConfig.SetStdinFile(fn)
 }
 
 // Run implements Runner.Run
-func (runner WasmtimeRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
+func (runner *WasmtimeRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
 	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer, ctx context.Context) error {
-	fn := filepath.Join(conf.BaseDir, cmdname)
-	bytecode, err := os.ReadFile(fn)
+	ctx, cancel := wasmDeadline(conf, ctx)
+	defer cancel()
+	wm, err := runner.cache.get(filepath.Join(conf.BaseDir, cmdname), memoryPages(conf))
 	if err != nil {
-		slog.Error("read bytecode", "error", err, "filename", fn)
 		return err
 	}
-	slog.Debug("bytecode read", "length", len(bytecode), "filename", fn)
-	engine := wasmtime.NewEngine()
-	module, err := wasmtime.NewModule(engine, bytecode)
+	e, err := wm.acquire()
 	if err != nil {
 		slog.Error("wasmtime module", "error", err)
 		return err
 	}
+	engine, module := e.engine, e.module
 	linker := wasmtime.NewLinker(engine)
 	err = linker.DefineWasi()
 	if err != nil {
@@ -41,37 +199,58 @@ func (runner WasmtimeRunner) Run(conf SrvConfig, cmdname string, envvar map[stri
 	wasiConfig := wasmtime.NewWasiConfig()
 	keys := []string{}
 	vals := []string{}
-	for k, v := range envvar {
+	for k, v := range wasmEnv(envvar, ctx) {
 		keys = append(keys, k)
 		vals = append(vals, v)
 	}
 	wasiConfig.SetEnv(keys, vals)
-	dir, err := os.MkdirTemp("", "out")
-	if err != nil {
-		slog.Error("mkdtemp", "error", err)
+	preopens := wasmPreopens(conf, cmdname, ctx)
+	// wasmtime-go has no permission of preopened directory. rejected at startup by checkPreopens
+	if err := writablePreopens(preopens, "wasmtime"); err != nil {
 		return err
 	}
-	defer os.RemoveAll(dir)
-	slog.Debug("tmp dir", "dir", dir)
-	stdoutPath := filepath.Join(dir, "stdout")
-	stderrPath := filepath.Join(dir, "stderr")
-	stdinPath := filepath.Join(dir, "stdin")
-	stdinFp, err := os.OpenFile(stdinPath, os.O_WRONLY|os.O_CREATE, 0755)
-	if err != nil {
-		slog.Error("open stdin", "error", err)
-		return err
+	for _, p := range preopens {
+		if err := wasiConfig.PreopenDir(p.Host, p.Guest); err != nil {
+			slog.Error("preopen", "error", err, "host", p.Host, "guest", p.Guest)
+			return err
+		}
 	}
-	io.Copy(stdinFp, stdin)
-	err = stdinFp.Close()
+	stdio, err := newWasmtimeStdio(wasiConfig, stdin, stdout, stderr)
 	if err != nil {
-		slog.Error("stdin close", "error", err)
 		return err
 	}
-	wasiConfig.SetStdinFile(stdinPath)
-	wasiConfig.SetStdoutFile(stdoutPath)
-	wasiConfig.SetStderrFile(stderrPath)
+	defer stdio.finish()
 	store := wasmtime.NewStore(engine)
 	store.SetWasi(wasiConfig)
+	if err := blockingStdin(linker, store, e.fdflags); err != nil {
+		slog.Error("define wasi", "error", err)
+		return err
+	}
+	store.SetEpochDeadline(1)
+	fuel := conf.WasmFuel
+	if fuel == 0 {
+		fuel = math.MaxInt64
+	}
+	if err := store.AddFuel(fuel); err != nil {
+		slog.Error("add fuel", "error", err)
+		return err
+	}
+	// deadline is relative to current epoch. the engine is reused after the watcher stops
+	finished := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			engine.IncrementEpoch()
+		case <-finished:
+		}
+	}()
+	defer func() {
+		close(finished)
+		<-stopped
+		wm.release(e)
+	}()
 	instance, err := linker.Instantiate(store, module)
 	if err != nil {
 		slog.Error("wasmtime instantiate", "error", err)
@@ -79,45 +258,54 @@ func (runner WasmtimeRunner) Run(conf SrvConfig, cmdname string, envvar map[stri
 	}
 	cgi := instance.GetFunc(store, "_start")
 	res, err := cgi.Call(store)
-	if err != nil {
-		slog.Error("wasmtime run", "error", err)
+	if ctx.Err() != nil {
+		slog.Warn("cancelled", "error", err)
+		return context.Cause(ctx)
+	}
+	if consumed, ok := store.FuelConsumed(); ok && consumed >= fuel {
+		slog.Warn("fuel exhausted", "error", err, "fuel", fuel)
+		return fmt.Errorf("%w: fuel %d exhausted", ErrTimeout, fuel)
 	}
 	if res != nil {
 		slog.Debug("result", "res", res)
-	} else {
-		slog.Debug("result(nil)")
 	}
-	stdoutContent, err := os.ReadFile(stdoutPath)
-	if err != nil {
-		slog.Error("reading stdout", "error", err)
-		return err
+	return wasmtimeResult(ctx, err)
+}
+
+// wasmtimeResult converts exit and trap of wasmtime. wasmtime-go has no exit status but the message
+func wasmtimeResult(ctx context.Context, err error) error {
+	if err == nil {
+		return wasmResult(ctx, nil, 0, false, "")
 	}
-	cnt, err := stdout.Write(stdoutContent)
-	if err != nil {
-		slog.Error("writing stdout", "error", err)
-	} else {
-		slog.Debug("stdout", "cnt", cnt)
+	msg, _, _ := strings.Cut(err.Error(), "\nwasm backtrace:")
+	var code int
+	if _, serr := fmt.Sscanf(msg, "Exited with i32 exit status %d", &code); serr == nil {
+		return wasmResult(ctx, err, code, true, "")
 	}
-	stderrContent, err := os.ReadFile(stderrPath)
-	if err != nil {
-		slog.Error("reading stderr", "error", err)
-	} else if len(stderrContent) != 0 {
-		cnt, err := stderr.Write(stderrContent)
-		if err != nil {
-			slog.Error("writing stderr", "error", err, "content", string(stderrContent))
-		} else {
-			slog.Debug("stderr", "cnt", cnt, "content", string(stderrContent))
+	stack := []string{}
+	var trap *wasmtime.Trap
+	if errors.As(err, &trap) {
+		for _, f := range trap.Frames() {
+			name := fmt.Sprintf("func[%d]", f.FuncIndex())
+			if n := f.FuncName(); n != nil {
+				name = *n
+			}
+			stack = append(stack, fmt.Sprintf("%s+%#x", name, f.FuncOffset()))
 		}
 	}
-	return nil
+	return wasmResult(ctx, errors.New(msg), 0, false, strings.Join(stack, "\n"))
 }
 
-func (runner WasmtimeRunner) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
+func (runner *WasmtimeRunner) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
 	return splitPathInfo(conf.BaseDir, path, conf.Suffix)
 }
 
 func init() {
-	runnerMap["wasmtime"] = func(SrvConfig) Runner {
-		return WasmtimeRunner{}
+	runnerMap["wasmtime"] = func(conf SrvConfig) Runner {
+		if err := checkPreopens(conf, "wasmtime"); err != nil {
+			slog.Error("wasm preopen", "error", err)
+			panic(fmt.Sprintf("wasm preopen error: %s", err))
+		}
+		return newWasmtimeRunner(conf)
 	}
 }
@@ -0,0 +1,56 @@
+//go:build wasmtime && !unix
+
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// wasmtimeStdio passes output of the module by temporary files
+type wasmtimeStdio struct {
+	dir    string
+	stdout io.Writer
+	stderr io.Writer
+}
+
+func newWasmtimeStdio(wasiConfig *wasmtime.WasiConfig, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*wasmtimeStdio, error) {
+	dir, err := os.MkdirTemp("", "stdio")
+	if err != nil {
+		slog.Error("mkdtemp", "error", err)
+		return nil, err
+	}
+	res := &wasmtimeStdio{dir: dir, stdout: stdout, stderr: stderr}
+	if err := spoolStdin(wasiConfig, dir, stdin); err != nil {
+		res.finish()
+		return nil, err
+	}
+	if err := wasiConfig.SetStdoutFile(filepath.Join(dir, "stdout")); err != nil {
+		res.finish()
+		return nil, err
+	}
+	if err := wasiConfig.SetStderrFile(filepath.Join(dir, "stderr")); err != nil {
+		res.finish()
+		return nil, err
+	}
+	return res, nil
+}
+
+// finish copies output after the module returns
+func (s *wasmtimeStdio) finish() {
+	for name, output := range map[string]io.Writer{"stdout": s.stdout, "stderr": s.stderr} {
+		fp, err := os.Open(filepath.Join(s.dir, name))
+		if err != nil {
+			continue
+		}
+		if _, err := io.Copy(output, fp); err != nil {
+			slog.Error("write output", "error", err, "name", name)
+		}
+		fp.Close()
+	}
+	os.RemoveAll(s.dir)
+}
@@ -2,8 +2,128 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
 
 func TestWasmtime(t *testing.T) {
-	testWasmAll(t, &WasmtimeRunner{})
+	testWasmAll(t, newWasmtimeRunner(SrvConfig{}))
+}
+
+func TestWasmtimeWorkDir(t *testing.T) {
+	t.Parallel()
+	// Go guests resolve relative path from absolute cwd and can not use "." preopen of wasmtime
+	testWasmWorkDir(t, newWasmtimeRunner(SrvConfig{}), func(t *testing.T, filename string) {
+		wasm, err := wasmtime.Wat2Wasm(readFileWat)
+		if err != nil {
+			t.Fatal("wat2wasm", err)
+		}
+		if err := os.WriteFile(filename, wasm, 0644); err != nil {
+			t.Fatal("writefile", err)
+		}
+	})
+}
+
+// readFileWat writes header and data.txt of the first preopen (fd 3) to stdout
+const readFileWat = `(module
+  (import "wasi_snapshot_preview1" "path_open"
+    (func $path_open (param i32 i32 i32 i32 i32 i64 i64 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_read" (func $fd_read (param i32 i32 i32 i32) (result i32)))
+  (import "wasi_snapshot_preview1" "fd_write" (func $fd_write (param i32 i32 i32 i32) (result i32)))
+  (memory (export "memory") 1)
+  (data (i32.const 0) "data.txt")
+  (data (i32.const 16) "Content-Type: text/plain\n\n")
+  (func (export "_start")
+    (i32.store (i32.const 100) (i32.const 16))
+    (i32.store (i32.const 104) (i32.const 26))
+    (drop (call $fd_write (i32.const 1) (i32.const 100) (i32.const 1) (i32.const 200)))
+    (if (call $path_open (i32.const 3) (i32.const 0) (i32.const 0) (i32.const 8)
+          (i32.const 0) (i64.const 2) (i64.const 0) (i32.const 0) (i32.const 300))
+      (then (unreachable)))
+    (i32.store (i32.const 100) (i32.const 1024))
+    (i32.store (i32.const 104) (i32.const 1024))
+    (drop (call $fd_read (i32.load (i32.const 300)) (i32.const 100) (i32.const 1) (i32.const 200)))
+    (i32.store (i32.const 104) (i32.load (i32.const 200)))
+    (drop (call $fd_write (i32.const 1) (i32.const 100) (i32.const 1) (i32.const 200)))))`
+
+func TestWasmtimeMemoryGrow(t *testing.T) {
+	t.Parallel()
+	testWasmMemoryGrow(t, newWasmtimeRunner(SrvConfig{}))
+}
+
+func TestWasmtimePreopen(t *testing.T) {
+	t.Parallel()
+	runner := newWasmtimeRunner(SrvConfig{})
+	if out, err := testWasmPreopen(t, runner, "rw"); out != "Content-Type: text/plain\n\ndata" || err != nil {
+		t.Error("rw", out, err)
+	}
+	// not supported
+	if _, err := testWasmPreopen(t, runner, "ro"); err == nil {
+		t.Error("ro")
+	}
+}
+
+func TestWasmtimeStream(t *testing.T) {
+	t.Parallel()
+	testWasmStream(t, newWasmtimeRunner(SrvConfig{}))
+}
+
+func TestWasmtimeScratch(t *testing.T) {
+	t.Parallel()
+	testWasmScratch(t, newWasmtimeRunner(SrvConfig{}))
+}
+
+func TestWasmtimeCompile(t *testing.T) {
+	t.Parallel()
+	testWasmCompile(t, func(conf SrvConfig) Runner { return newWasmtimeRunner(conf) })
+}
+
+func TestWasmtimeFuel(t *testing.T) {
+	t.Parallel()
+	conf := SrvConfig{}
+	conf.Timeout = 10 * time.Second
+	conf.BaseDir = t.TempDir()
+	conf.WasmFuel = 1_000_000
+	if err := os.WriteFile(filepath.Join(conf.BaseDir, "loop.wasm"), loopWasm, 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	err := newWasmtimeRunner(conf).Run(conf, "loop.wasm", map[string]string{}, stdin, &bytes.Buffer{}, &bytes.Buffer{}, context.Background())
+	if !errors.Is(err, ErrTimeout) || !strings.Contains(err.Error(), "fuel") {
+		t.Error("fuel", err)
+	}
+}
+
+func TestWasmtimeEngineReuse(t *testing.T) {
+	t.Parallel()
+	conf := SrvConfig{}
+	conf.Timeout = 200 * time.Millisecond
+	conf.BaseDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(conf.BaseDir, "loop.wasm"), loopWasm, 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	runner := newWasmtimeRunner(conf)
+	// engine interrupted by the previous request runs the next one until its deadline
+	for i := range 3 {
+		start := time.Now()
+		stdin := io.NopCloser(bytes.NewBufferString(""))
+		err := runner.Run(conf, "loop.wasm", map[string]string{}, stdin, &bytes.Buffer{}, &bytes.Buffer{}, context.Background())
+		if !errors.Is(err, ErrTimeout) || time.Since(start) < conf.Timeout {
+			t.Error("timeout", i, err, time.Since(start))
+		}
+	}
+	wm, err := runner.cache.get(filepath.Join(conf.BaseDir, "loop.wasm"), 0)
+	if err != nil || len(wm.idle) != 1 {
+		t.Error("idle", err)
+	}
 }
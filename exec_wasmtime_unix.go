@@ -0,0 +1,166 @@
+//go:build wasmtime && unix
+
+package main
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/bytecodealliance/wasmtime-go"
+)
+
+// fifoOutput copies output of the module from FIFO
+type fifoOutput struct {
+	fp     *os.File
+	output io.Writer // nil after write error
+}
+
+func (o *fifoOutput) write(data []byte) {
+	if o.output == nil {
+		return
+	}
+	if _, err := o.output.Write(data); err != nil {
+		slog.Error("write output", "error", err)
+		// keep reading not to block the module
+		o.output = nil
+	}
+}
+
+// copy reads until error, including read deadline
+func (o *fifoOutput) copy() {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := o.fp.Read(buf)
+		o.write(buf[:n])
+		if err != nil {
+			return
+		}
+	}
+}
+
+// drain reads remaining data without blocking
+func (o *fifoOutput) drain() error {
+	if err := o.fp.SetReadDeadline(time.Time{}); err != nil {
+		return err
+	}
+	rc, err := o.fp.SyscallConn()
+	if err != nil {
+		return err
+	}
+	buf := make([]byte, 32*1024)
+	return rc.Read(func(fd uintptr) bool {
+		for {
+			n, err := syscall.Read(int(fd), buf)
+			if n <= 0 || err != nil {
+				return true
+			}
+			o.write(buf[:n])
+		}
+	})
+}
+
+// wasmtimeStdio streams stdio of the module through FIFOs, since wasmtime-go accepts only file paths.
+// output FIFOs are opened read-write not to block and not to wait for the module to close them
+type wasmtimeStdio struct {
+	dir     string
+	input   *os.File // write end of stdin FIFO
+	outputs []*fifoOutput
+	wg      sync.WaitGroup
+}
+
+// streamStdin copies stdin to FIFO opened by wasmtime. the module gets EOF when the copy finishes
+func (s *wasmtimeStdio) streamStdin(wasiConfig *wasmtime.WasiConfig, stdin io.Reader) error {
+	fn := filepath.Join(s.dir, "stdin")
+	if err := syscall.Mkfifo(fn, 0600); err != nil {
+		return err
+	}
+	// keeps FIFO open not to block wasmtime opening the read end
+	holder, err := os.OpenFile(fn, os.O_RDWR, 0)
+	if err != nil {
+		return err
+	}
+	defer holder.Close()
+	if err := wasiConfig.SetStdinFile(fn); err != nil {
+		return err
+	}
+	if s.input, err = os.OpenFile(fn, os.O_WRONLY, 0); err != nil {
+		return err
+	}
+	input := s.input
+	go func() {
+		if _, err := io.Copy(input, stdin); err != nil && !errors.Is(err, os.ErrClosed) {
+			slog.Error("write stdin", "error", err)
+		}
+		input.Close()
+	}()
+	return nil
+}
+
+func newWasmtimeStdio(wasiConfig *wasmtime.WasiConfig, stdin io.Reader, stdout io.Writer, stderr io.Writer) (*wasmtimeStdio, error) {
+	dir, err := os.MkdirTemp("", "stdio")
+	if err != nil {
+		slog.Error("mkdtemp", "error", err)
+		return nil, err
+	}
+	res := &wasmtimeStdio{dir: dir}
+	mkfifo := func(name string) (*os.File, error) {
+		fn := filepath.Join(dir, name)
+		if err := syscall.Mkfifo(fn, 0600); err != nil {
+			return nil, err
+		}
+		return os.OpenFile(fn, os.O_RDWR, 0)
+	}
+	if err := res.streamStdin(wasiConfig, stdin); err != nil {
+		slog.Error("input fifo", "error", err)
+		res.finish()
+		return nil, err
+	}
+	for name, output := range map[string]io.Writer{"stdout": stdout, "stderr": stderr} {
+		fp, err := mkfifo(name)
+		if err != nil {
+			slog.Error("output fifo", "error", err, "name", name)
+			res.finish()
+			return nil, err
+		}
+		res.outputs = append(res.outputs, &fifoOutput{fp: fp, output: output})
+	}
+	if err := wasiConfig.SetStdoutFile(filepath.Join(dir, "stdout")); err != nil {
+		res.finish()
+		return nil, err
+	}
+	if err := wasiConfig.SetStderrFile(filepath.Join(dir, "stderr")); err != nil {
+		res.finish()
+		return nil, err
+	}
+	for _, o := range res.outputs {
+		res.wg.Go(o.copy)
+	}
+	return res, nil
+}
+
+// finish copies the rest of output after the module returns
+func (s *wasmtimeStdio) finish() {
+	if s.input != nil {
+		// unblocks the copy if the module did not read all
+		s.input.Close()
+	}
+	for _, o := range s.outputs {
+		if err := o.fp.SetReadDeadline(time.Now()); err != nil {
+			slog.Error("read deadline", "error", err)
+		}
+	}
+	s.wg.Wait()
+	for _, o := range s.outputs {
+		if err := o.drain(); err != nil {
+			slog.Error("drain output", "error", err)
+		}
+		o.fp.Close()
+	}
+	os.RemoveAll(s.dir)
+}
@@ -3,59 +3,239 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
 	"io"
 	"log/slog"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 
 	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/experimental"
 	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+	"github.com/tetratelabs/wazero/sys"
 )
 
-// WazeroRunner implements CGI Runner execute by wasmer
+// WazeroRunner implements CGI Runner execute by wazero
 type WazeroRunner struct {
+	rt        wazero.Runtime
+	cache     *moduleCache[wazero.CompiledModule]
+	profCache *moduleCache[wazero.CompiledModule] // compiled with function listener. nil if profiling is disabled
+	profileMu sync.Mutex
+	kvStores  kvStores
 }
 
-func (runner WazeroRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
+// newWazeroRunner returns WazeroRunner with shared runtime
+func newWazeroRunner(conf SrvConfig) (*WazeroRunner, error) {
+	ctx := context.Background()
+	// the module is closed when the request context is cancelled
+	rtconf := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if conf.WasmCacheDir != "" {
+		cache, err := wazero.NewCompilationCacheWithDir(conf.WasmCacheDir)
+		if err != nil {
+			slog.Error("compilation cache", "error", err, "dir", conf.WasmCacheDir)
+			return nil, err
+		}
+		rtconf = rtconf.WithCompilationCache(cache)
+	}
+	rt := wazero.NewRuntimeWithConfig(ctx, rtconf)
+	profiling := profileEnabled(conf)
+	hostctx := ctx
+	if profiling {
+		// host calls are recorded only when the request is profiled
+		hostctx = experimental.WithFunctionListenerFactory(ctx, listenerFactory(hostListener{}))
+	}
+	wasi_snapshot_preview1.MustInstantiate(hostctx, rt)
+	if err := instantiateHost(hostctx, rt); err != nil {
+		slog.Error("host module", "error", err)
+		return nil, err
+	}
+	compile := func(bytecode []byte) (wazero.CompiledModule, error) {
+		return compileWazero(conf, rt, ctx, bytecode)
+	}
+	evict := func(code wazero.CompiledModule) {
+		// safe while instances of the module are running
+		code.Close(ctx)
+	}
+	res := &WazeroRunner{
+		rt:    rt,
+		cache: newModuleCache(conf.WasmCacheSize, compile, evict),
+	}
+	if profiling {
+		profctx := experimental.WithFunctionListenerFactory(ctx, listenerFactory(guestListener{}))
+		compileProf := func(bytecode []byte) (wazero.CompiledModule, error) {
+			return compileWazero(conf, rt, profctx, bytecode)
+		}
+		res.profCache = newModuleCache(min(conf.WasmCacheSize, wasmProfileCacheSize), compileProf, evict)
+	}
+	return res, nil
+}
+
+// compileWazero compiles the module. wazero fails with broken artifact in the compilation cache,
+// then broken artifacts are removed and the module is compiled again
+func compileWazero(conf SrvConfig, rt wazero.Runtime, ctx context.Context, bytecode []byte) (wazero.CompiledModule, error) {
+	code, err := rt.CompileModule(ctx, bytecode)
+	if err == nil || conf.WasmCacheDir == "" {
+		return code, err
+	}
+	removed, rerr := removeBrokenArtifacts(conf.WasmCacheDir)
+	if rerr != nil {
+		slog.Error("remove artifact", "error", rerr, "dir", conf.WasmCacheDir)
+	}
+	if removed == 0 {
+		// not caused by the cache
+		return nil, err
+	}
+	slog.Warn("broken artifact, recompile", "error", err, "removed", removed)
+	return rt.CompileModule(ctx, bytecode)
+}
+
+// removeBrokenArtifacts removes artifacts which wazero can not read, in per-version directories created by wazero.
+// valid artifacts and temporary files being written by other compiles are kept
+func removeBrokenArtifacts(dir string) (int, error) {
+	files, err := filepath.Glob(filepath.Join(dir, "wazero-*", "*"))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, fn := range files {
+		if strings.HasSuffix(fn, ".tmp") {
+			continue
+		}
+		data, err := os.ReadFile(fn)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if validArtifact(data) {
+			continue
+		}
+		if err := os.Remove(fn); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return removed, err
+		}
+		slog.Info("removed broken artifact", "filename", fn)
+		removed++
+	}
+	return removed, nil
+}
+
+// validArtifact checks header and checksum of the artifact written by wazero:
+// "WAZEVO", version (length and string), number of functions (u32), offset of each function (u64),
+// length of native code (u64), native code and its CRC-32C (u32), followed by metadata
+func validArtifact(data []byte) bool {
+	rest, ok := bytes.CutPrefix(data, []byte("WAZEVO"))
+	if !ok || len(rest) < 1 || len(rest) < 1+int(rest[0])+4 {
+		return false
+	}
+	rest = rest[1+int(rest[0]):]
+	nfunc := uint64(binary.LittleEndian.Uint32(rest))
+	rest = rest[4:]
+	if uint64(len(rest)) < nfunc*8+8 {
+		return false
+	}
+	rest = rest[nfunc*8:]
+	size := binary.LittleEndian.Uint64(rest)
+	rest = rest[8:]
+	if size > uint64(len(rest)) || uint64(len(rest))-size < 4 {
+		return false
+	}
+	return crc32.Checksum(rest[:size], crc32.MakeTable(crc32.Castagnoli)) == binary.LittleEndian.Uint32(rest[size:])
+}
+
+// module returns compiled module. profiled module is compiled with function listener
+func (runner *WazeroRunner) module(conf SrvConfig, path string) (wazero.CompiledModule, error) {
+	if conf.WasmProfile && runner.profCache != nil {
+		return runner.profCache.get(path, memoryPages(conf))
+	}
+	return runner.cache.get(path, memoryPages(conf))
+}
+
+// Compile implements Compiler. wazero saves the artifact in its compilation cache
+func (runner *WazeroRunner) Compile(conf SrvConfig, cmdname string) error {
+	if conf.WasmCacheDir == "" {
+		return errors.New("--wasm-cache-dir is required")
+	}
+	_, err := runner.module(conf, filepath.Join(conf.BaseDir, cmdname))
+	return err
+}
+
+func (runner *WazeroRunner) Run(conf SrvConfig, cmdname string, envvar map[string]string,
 	stdin io.ReadCloser, stdout io.Writer, stderr io.Writer,
 	ctx context.Context) error {
-	fn := filepath.Join(conf.BaseDir, cmdname)
-	bytecode, err := os.ReadFile(fn)
+	ctx, cancel := wasmDeadline(conf, ctx)
+	defer cancel()
+	code, err := runner.module(conf, filepath.Join(conf.BaseDir, cmdname))
 	if err != nil {
-		slog.Error("read bytecode", "error", err, "filename", fn)
 		return err
 	}
-	slog.Debug("bytecode read", "length", len(bytecode), "filename", fn)
-	rt := wazero.NewRuntime(ctx)
-	defer rt.Close(ctx)
+	if ctx, err = runner.withWasmHost(conf, cmdname, ctx); err != nil {
+		return err
+	}
+	ctx, finish := runner.startProfile(conf, cmdname, ctx)
+	defer finish()
+	// anonymous, to run instances of the module concurrently
 	wconf := wazero.NewModuleConfig().
+		WithName("").
 		WithStdout(stdout).
 		WithStderr(stderr).
 		WithStdin(stdin).
 		WithStartFunctions("_start")
-	for k, v := range envvar {
+	for k, v := range wasmEnv(envvar, ctx) {
 		wconf = wconf.WithEnv(k, v)
 	}
-	code, err := rt.CompileModule(ctx, bytecode)
-	if err != nil {
-		slog.Error("compile", "error", err)
-		return err
+	fsconf := wazero.NewFSConfig()
+	for _, p := range wasmPreopens(conf, cmdname, ctx) {
+		if p.ReadOnly {
+			fsconf = fsconf.WithReadOnlyDirMount(p.Host, p.Guest)
+		} else {
+			fsconf = fsconf.WithDirMount(p.Host, p.Guest)
+		}
+	}
+	wconf = wconf.WithFSConfig(fsconf)
+	mod, err := runner.rt.InstantiateModule(ctx, code, wconf)
+	if mod != nil {
+		defer mod.Close(context.WithoutCancel(ctx))
 	}
-	wasi_snapshot_preview1.MustInstantiate(ctx, rt)
-	_, err = rt.InstantiateModule(ctx, code, wconf)
+	if ctx.Err() != nil {
+		slog.Warn("cancelled", "error", err)
+		return context.Cause(ctx)
+	}
+	return wazeroResult(ctx, err)
+}
+
+// wazeroResult converts exit and trap of wazero
+func wazeroResult(ctx context.Context, err error) error {
+	var exitErr *sys.ExitError
+	if errors.As(err, &exitErr) {
+		return wasmResult(ctx, err, int(exitErr.ExitCode()), true, "")
+	}
+	var stack string
 	if err != nil {
-		slog.Error("instantiate", "error", err)
+		if msg, st, ok := strings.Cut(err.Error(), "\nwasm stack trace:\n"); ok {
+			err = errors.New(msg)
+			stack = strings.ReplaceAll(st, "\t", "")
+		}
 	}
-	return err
+	return wasmResult(ctx, err, 0, false, stack)
 }
 
-func (runner WazeroRunner) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
+func (runner *WazeroRunner) Exists(conf SrvConfig, path string, ctx context.Context) (string, string, error) {
 	return splitPathInfo(conf.BaseDir, path, conf.Suffix)
 }
 
 func init() {
-	runnerMap["wazero"] = func(SrvConfig) Runner {
-		return WazeroRunner{}
+	runnerMap["wazero"] = func(conf SrvConfig) Runner {
+		runner, err := newWazeroRunner(conf)
+		if err != nil {
+			panic(fmt.Sprintf("wazero runtime error: %s", err))
+		}
+		return runner
 	}
 }
@@ -0,0 +1,201 @@
+//go:build wazero
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// wasmHostModule is the name of host module imported by the guest
+const wasmHostModule = "httpcgi"
+
+// wasmHostNotFound is returned to the guest for missing value
+const wasmHostNotFound = -1
+
+var errGuestMemory = errors.New("out of guest memory range")
+
+// wasmHost is per-request state of host functions
+type wasmHost struct {
+	logger *slog.Logger
+	req    *http.Request // nil if not from HTTP
+	kv     *kvStore      // nil if disabled
+	http   *wasmHTTP     // nil if no host is allowed
+}
+
+type wasmHostKey struct{}
+
+// withWasmHost returns context with the state of host functions for the script
+func (runner *WazeroRunner) withWasmHost(conf SrvConfig, cmdname string, ctx context.Context) (context.Context, error) {
+	host := &wasmHost{
+		logger: slog.With("script", cmdname),
+		req:    requestFrom(ctx),
+	}
+	if conf.WasmKVFile != "" {
+		kv, err := runner.kvStores.open(conf.WasmKVFile)
+		if err != nil {
+			slog.Error("kv store", "error", err, "filename", conf.WasmKVFile)
+			return nil, err
+		}
+		host.kv = kv
+	}
+	if len(conf.WasmHTTPAllow) != 0 {
+		host.http = &wasmHTTP{allow: conf.WasmHTTPAllow, conf: conf}
+	}
+	return context.WithValue(ctx, wasmHostKey{}, host), nil
+}
+
+func wasmHostFrom(ctx context.Context) *wasmHost {
+	if host, ok := ctx.Value(wasmHostKey{}).(*wasmHost); ok {
+		return host
+	}
+	// e.g. _routes of WAGI module
+	return &wasmHost{logger: slog.Default()}
+}
+
+// readGuest returns string in guest memory. traps the guest if out of range
+func readGuest(mod api.Module, ptr, size uint32) string {
+	buf, ok := mod.Memory().Read(ptr, size)
+	if !ok {
+		panic(fmt.Errorf("%w: read %d+%d", errGuestMemory, ptr, size))
+	}
+	return string(buf)
+}
+
+// writeGuest writes value into guest buffer if it fits. returns length of the value
+func writeGuest(mod api.Module, ptr, size uint32, value string) int32 {
+	if len(value) <= int(size) && !mod.Memory().WriteString(ptr, value) {
+		panic(fmt.Errorf("%w: write %d+%d", errGuestMemory, ptr, len(value)))
+	}
+	return int32(len(value))
+}
+
+// requestMeta returns metadata of the request not in CGI variables
+func requestMeta(r *http.Request, key string) (string, bool) {
+	if r == nil {
+		return "", false
+	}
+	if name, ok := strings.CutPrefix(key, "header."); ok {
+		values := r.Header.Values(name)
+		return strings.Join(values, ", "), len(values) != 0
+	}
+	switch key {
+	case "method":
+		return r.Method, true
+	case "uri":
+		return r.RequestURI, true
+	case "host":
+		return r.Host, true
+	case "proto":
+		return r.Proto, true
+	case "remote_addr":
+		return r.RemoteAddr, true
+	case "scheme":
+		if r.TLS != nil {
+			return "https", true
+		}
+		return "http", true
+	case "tls_server_name":
+		if r.TLS != nil {
+			return r.TLS.ServerName, true
+		}
+	}
+	return "", false
+}
+
+// instantiateHost defines httpcgi host module. strings are passed by pointer and length.
+// functions writing into guest buffer return length of the value, and write nothing if it doesn't fit
+func instantiateHost(ctx context.Context, rt wazero.Runtime) error {
+	_, err := rt.NewHostModuleBuilder(wasmHostModule).
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, level int32, ptr, size uint32) {
+			host := wasmHostFrom(ctx)
+			msg := readGuest(mod, ptr, size)
+			args := []any{}
+			if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+				args = append(args, "trace_id", sc.TraceID().String(), "span_id", sc.SpanID().String())
+			}
+			host.logger.Log(ctx, slog.Level(level), msg, args...)
+		}).
+		WithParameterNames("level", "msg", "msg_len").
+		Export("log").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, ptr, size uint32) int32 {
+			carrier := propagation.MapCarrier{}
+			propagation.TraceContext{}.Inject(ctx, carrier)
+			return writeGuest(mod, ptr, size, carrier.Get("traceparent"))
+		}).
+		WithParameterNames("buf", "buf_len").
+		Export("trace_context").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, kptr, ksize, ptr, size uint32) int32 {
+			value, ok := requestMeta(wasmHostFrom(ctx).req, readGuest(mod, kptr, ksize))
+			if !ok {
+				return wasmHostNotFound
+			}
+			return writeGuest(mod, ptr, size, value)
+		}).
+		WithParameterNames("key", "key_len", "buf", "buf_len").
+		Export("request_meta").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, kptr, ksize, ptr, size uint32) int32 {
+			kv := wasmHostFrom(ctx).kv
+			if kv == nil {
+				return wasmHostNotFound
+			}
+			value, ok := kv.Get(readGuest(mod, kptr, ksize))
+			if !ok {
+				return wasmHostNotFound
+			}
+			return writeGuest(mod, ptr, size, value)
+		}).
+		WithParameterNames("key", "key_len", "buf", "buf_len").
+		Export("kv_get").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, kptr, ksize, vptr, vsize uint32) int32 {
+			host := wasmHostFrom(ctx)
+			if host.kv == nil {
+				return -1
+			}
+			if err := host.kv.Set(readGuest(mod, kptr, ksize), readGuest(mod, vptr, vsize)); err != nil {
+				host.logger.Error("kv set", "error", err)
+				return -1
+			}
+			return 0
+		}).
+		WithParameterNames("key", "key_len", "value", "value_len").
+		Export("kv_set").
+		NewFunctionBuilder().
+		WithFunc(func(ctx context.Context, mod api.Module, kptr, ksize uint32) int32 {
+			host := wasmHostFrom(ctx)
+			if host.kv == nil {
+				return -1
+			}
+			if err := host.kv.Delete(readGuest(mod, kptr, ksize)); err != nil {
+				host.logger.Error("kv delete", "error", err)
+				return -1
+			}
+			return 0
+		}).
+		WithParameterNames("key", "key_len").
+		Export("kv_delete").
+		NewFunctionBuilder().
+		WithFunc(httpRequest).
+		WithParameterNames("method", "method_len", "url", "url_len", "headers", "headers_len", "body", "body_len").
+		Export("http_request").
+		NewFunctionBuilder().
+		WithFunc(httpResponse).
+		WithParameterNames("buf", "buf_len").
+		Export("http_response").
+		Instantiate(ctx)
+	return err
+}
@@ -0,0 +1,122 @@
+//go:build wazero
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// hostSrc is a module calling httpcgi host functions
+const hostSrc = `package main
+
+import (
+	"fmt"
+	"strconv"
+	"unsafe"
+)
+
+//go:wasmimport httpcgi log
+func hostLog(level int32, msg unsafe.Pointer, size uint32)
+
+//go:wasmimport httpcgi trace_context
+func traceContext(buf unsafe.Pointer, size uint32) int32
+
+//go:wasmimport httpcgi request_meta
+func requestMeta(key unsafe.Pointer, ksize uint32, buf unsafe.Pointer, size uint32) int32
+
+//go:wasmimport httpcgi kv_get
+func kvGet(key unsafe.Pointer, ksize uint32, buf unsafe.Pointer, size uint32) int32
+
+//go:wasmimport httpcgi kv_set
+func kvSet(key unsafe.Pointer, ksize uint32, value unsafe.Pointer, vsize uint32) int32
+
+func ptr(s string) (unsafe.Pointer, uint32) {
+	return unsafe.Pointer(unsafe.StringData(s)), uint32(len(s))
+}
+
+func get(fn func(unsafe.Pointer, uint32, unsafe.Pointer, uint32) int32, key string) string {
+	buf := make([]byte, 8)
+	kp, ks := ptr(key)
+	n := fn(kp, ks, unsafe.Pointer(&buf[0]), uint32(len(buf)))
+	if n > int32(len(buf)) {
+		buf = make([]byte, n)
+		n = fn(kp, ks, unsafe.Pointer(&buf[0]), uint32(len(buf)))
+	}
+	if n < 0 {
+		return "-"
+	}
+	return string(buf[:n])
+}
+
+func main() {
+	mp, ms := ptr("hello from guest")
+	hostLog(0, mp, ms)
+	buf := make([]byte, 64)
+	n := traceContext(unsafe.Pointer(&buf[0]), uint32(len(buf)))
+	count, _ := strconv.Atoi(get(kvGet, "count"))
+	kp, ks := ptr("count")
+	vp, vs := ptr(strconv.Itoa(count + 1))
+	if kvSet(kp, ks, vp, vs) != 0 {
+		fmt.Print("Status: 500\n\n")
+		return
+	}
+	fmt.Print("Content-Type: text/plain\n\n")
+	fmt.Println(string(buf[:n]))
+	fmt.Println(get(requestMeta, "method"), get(requestMeta, "header.X-Test"), get(requestMeta, "missing"))
+	fmt.Print(count)
+}
+`
+
+func TestWazeroHost(t *testing.T) {
+	t.Parallel()
+	runner := newTestWazeroRunner(t)
+	conf := SrvConfig{}
+	conf.Timeout = 10 * time.Second
+	conf.BaseDir = t.TempDir()
+	conf.WasmKVFile = filepath.Join(t.TempDir(), "kv.json")
+	buildWasm(t, filepath.Join(conf.BaseDir, "host.wasm"), hostSrc)
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	req := httptest.NewRequest("PUT", "/host.wasm", nil)
+	req.Header.Add("X-Test", "value1")
+	req.Header.Add("X-Test", "value2")
+	ctx := withRequest(trace.ContextWithSpanContext(context.Background(), sc), req)
+	for i, count := range []string{"0", "1"} {
+		stdin := io.NopCloser(bytes.NewBufferString(""))
+		stdout := &bytes.Buffer{}
+		if err := runner.Run(conf, "host.wasm", map[string]string{}, stdin, stdout, &bytes.Buffer{}, ctx); err != nil {
+			t.Fatal("run", i, err)
+		}
+		expected := "Content-Type: text/plain\n\n" +
+			"00-01020300000000000000000000000000-0405060000000000-01\n" +
+			"PUT value1, value2 -\n" + count
+		if stdout.String() != expected {
+			t.Error("output", i, stdout.String())
+		}
+	}
+	data, err := os.ReadFile(conf.WasmKVFile)
+	if err != nil || string(data) != `{"count":"2"}` {
+		t.Error("kv file", string(data), err)
+	}
+	// without request, trace and kv store
+	stdout := &bytes.Buffer{}
+	conf.WasmKVFile = ""
+	if err := runner.Run(conf, "host.wasm", map[string]string{}, io.NopCloser(&bytes.Buffer{}), stdout, &bytes.Buffer{}, context.Background()); err != nil {
+		t.Fatal("run", err)
+	}
+	if stdout.String() != "Status: 500\n\n" {
+		t.Error("output", stdout.String())
+	}
+}
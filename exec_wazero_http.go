@@ -0,0 +1,157 @@
+//go:build wazero
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/tetratelabs/wazero/api"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+)
+
+// error codes of http_request returned to the guest
+const (
+	wasmHTTPDenied   = -1
+	wasmHTTPFailed   = -2
+	wasmHTTPTooLarge = -3
+	wasmHTTPInvalid  = -4
+)
+
+var (
+	errHTTPDenied   = errors.New("not allowed")
+	errHTTPTooLarge = errors.New("response too large")
+)
+
+// allowHTTP returns error if the request is not in the allowlist
+func allowHTTP(allow []wasmHTTPAllow, method string, u *url.URL) error {
+	origin := httpOrigin(u)
+	for _, a := range allow {
+		if a.Origin == origin && (len(a.Methods) == 0 || slices.Contains(a.Methods, method)) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s %s", errHTTPDenied, method, origin)
+}
+
+// wasmHTTP is outbound HTTP client of the script
+type wasmHTTP struct {
+	allow    []wasmHTTPAllow
+	conf     SrvConfig
+	response []byte // last response, read by http_response
+}
+
+// parseHeaders parses "Name: value" lines
+func parseHeaders(data string) (http.Header, error) {
+	res := http.Header{}
+	for line := range strings.Lines(data) {
+		line = strings.TrimRight(line, "\r\n")
+		if line == "" {
+			continue
+		}
+		k, v, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("invalid header %q", line)
+		}
+		res.Add(strings.TrimSpace(k), strings.TrimSpace(v))
+	}
+	return res, nil
+}
+
+// do sends the request and keeps the response serialized as status line, headers, empty line and body
+func (h *wasmHTTP) do(ctx context.Context, method, rawurl string, header http.Header, body []byte) error {
+	if h.conf.WasmHTTPTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, h.conf.WasmHTTPTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, rawurl, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	if err := allowHTTP(h.allow, req.Method, req.URL); err != nil {
+		return err
+	}
+	req.Header = header
+	client := http.Client{
+		// propagates trace context of the request
+		Transport: otelhttp.NewTransport(http.DefaultTransport),
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			if len(via) >= 10 {
+				return errors.New("too many redirects")
+			}
+			return allowHTTP(h.allow, req.Method, req.URL)
+		},
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var rd io.Reader = resp.Body
+	limit := int64(h.conf.WasmHTTPMaxResponse)
+	if limit > 0 {
+		rd = io.LimitReader(resp.Body, limit+1)
+	}
+	buf := bytes.Buffer{}
+	fmt.Fprintf(&buf, "%d\n", resp.StatusCode)
+	for _, k := range slices.Sorted(maps.Keys(resp.Header)) {
+		for _, v := range resp.Header[k] {
+			fmt.Fprintf(&buf, "%s: %s\n", k, v)
+		}
+	}
+	buf.WriteString("\n")
+	n, err := io.Copy(&buf, rd)
+	if err != nil {
+		return err
+	}
+	if limit > 0 && n > limit {
+		return fmt.Errorf("%w: larger than %d", errHTTPTooLarge, limit)
+	}
+	h.response = buf.Bytes()
+	return nil
+}
+
+// httpRequest implements http_request host function. returns length of the response or error code
+func httpRequest(ctx context.Context, mod api.Module, mptr, msize, uptr, usize, hptr, hsize, bptr, bsize uint32) int32 {
+	host := wasmHostFrom(ctx)
+	if host.http == nil {
+		return wasmHTTPDenied
+	}
+	host.http.response = nil
+	method, rawurl := readGuest(mod, mptr, msize), readGuest(mod, uptr, usize)
+	header, err := parseHeaders(readGuest(mod, hptr, hsize))
+	if err != nil {
+		host.logger.Warn("http request", "error", err)
+		return wasmHTTPInvalid
+	}
+	body := []byte(readGuest(mod, bptr, bsize))
+	if err := host.http.do(ctx, method, rawurl, header, body); err != nil {
+		host.logger.Warn("http request", "error", err, "method", method, "url", rawurl)
+		switch {
+		case errors.Is(err, errHTTPDenied):
+			return wasmHTTPDenied
+		case errors.Is(err, errHTTPTooLarge):
+			return wasmHTTPTooLarge
+		}
+		return wasmHTTPFailed
+	}
+	return int32(len(host.http.response))
+}
+
+// httpResponse implements http_response host function. copies the last response
+func httpResponse(ctx context.Context, mod api.Module, ptr, size uint32) int32 {
+	host := wasmHostFrom(ctx)
+	if host.http == nil || host.http.response == nil {
+		return wasmHostNotFound
+	}
+	return writeGuest(mod, ptr, size, string(host.http.response))
+}
@@ -0,0 +1,166 @@
+//go:build wazero
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// httpSrc is a module calling http_request host function
+const httpSrc = `package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"unsafe"
+)
+
+//go:wasmimport httpcgi http_request
+func httpRequest(method unsafe.Pointer, msize uint32, url unsafe.Pointer, usize uint32,
+	headers unsafe.Pointer, hsize uint32, body unsafe.Pointer, bsize uint32) int32
+
+//go:wasmimport httpcgi http_response
+func httpResponse(buf unsafe.Pointer, size uint32) int32
+
+func ptr(s string) (unsafe.Pointer, uint32) {
+	return unsafe.Pointer(unsafe.StringData(s)), uint32(len(s))
+}
+
+func main() {
+	mp, ms := ptr(os.Getenv("METHOD"))
+	up, us := ptr(os.Getenv("TARGET"))
+	hp, hs := ptr("X-Test: hello\n")
+	bp, bs := ptr("request body")
+	n := httpRequest(mp, ms, up, us, hp, hs, bp, bs)
+	fmt.Print("Content-Type: text/plain\n\n")
+	if n < 0 {
+		fmt.Print(n)
+		return
+	}
+	buf := make([]byte, n)
+	httpResponse(unsafe.Pointer(&buf[0]), uint32(n))
+	status, rest, _ := strings.Cut(string(buf), "\n")
+	_, body, _ := strings.Cut(rest, "\n\n")
+	fmt.Print(status, " ", body)
+}
+`
+
+func TestWasmHTTPAllow(t *testing.T) {
+	t.Parallel()
+	allow := make([]wasmHTTPAllow, 3)
+	for i, v := range []string{"https://a.example.com", "get,POST=http://b.example.com:80", "http://c.example.com:8080/"} {
+		if err := allow[i].UnmarshalFlag(v); err != nil {
+			t.Fatal("unmarshal", v, err)
+		}
+	}
+	for _, v := range []string{"a.example.com", "ftp://a.example.com", "https://a.example.com/path", "GET=", "https://"} {
+		var a wasmHTTPAllow
+		if err := a.UnmarshalFlag(v); err == nil {
+			t.Error("invalid", v, a)
+		}
+	}
+	tests := []struct {
+		method, url string
+		allowed     bool
+	}{
+		{"DELETE", "https://a.example.com/x", true},
+		{"GET", "https://A.example.com:443/", true},
+		{"GET", "http://a.example.com/", false},
+		{"GET", "https://a.example.com:8443/", false},
+		{"POST", "http://b.example.com/x?y", true},
+		{"PUT", "http://b.example.com/", false},
+		{"GET", "http://c.example.com:8080", true},
+		{"GET", "http://c.example.com", false},
+		{"GET", "https://d.example.com", false},
+	}
+	for _, tt := range tests {
+		u, _ := url.Parse(tt.url)
+		if err := allowHTTP(allow, tt.method, u); (err == nil) != tt.allowed {
+			t.Error("allow", tt.method, tt.url, err)
+		}
+	}
+}
+
+func TestWazeroHTTP(t *testing.T) {
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	mux := http.NewServeMux()
+	mux.HandleFunc("/echo", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		fmt.Fprint(w, r.Method, " ", r.Header.Get("X-Test"), " ", r.Header.Get("Traceparent"), " ", string(body))
+	})
+	mux.HandleFunc("/large", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, strings.Repeat("x", 2000))
+	})
+	mux.HandleFunc("/slow", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-time.After(2 * time.Second):
+		case <-r.Context().Done():
+		}
+	})
+	mux.Handle("/redirect", http.RedirectHandler(other.URL, http.StatusFound))
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+
+	runner := newTestWazeroRunner(t)
+	conf := SrvConfig{}
+	conf.Timeout = 10 * time.Second
+	conf.BaseDir = t.TempDir()
+	conf.WasmHTTPTimeout = 500 * time.Millisecond
+	conf.WasmHTTPMaxResponse = 1000
+	buildWasm(t, filepath.Join(conf.BaseDir, "http.wasm"), httpSrc)
+	if err := conf.applyOptions(map[string]any{"wasm-http-allow": "GET,POST=" + srv.URL}); err != nil {
+		t.Fatal("option", err)
+	}
+	sc := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    trace.TraceID{1, 2, 3},
+		SpanID:     trace.SpanID{4, 5, 6},
+		TraceFlags: trace.FlagsSampled,
+	})
+	ctx := trace.ContextWithSpanContext(context.Background(), sc)
+	run := func(conf SrvConfig, method, target string) string {
+		stdout := &bytes.Buffer{}
+		env := map[string]string{"METHOD": method, "TARGET": target}
+		if err := runner.Run(conf, "http.wasm", env, io.NopCloser(&bytes.Buffer{}), stdout, &bytes.Buffer{}, ctx); err != nil {
+			t.Error("run", method, target, err)
+		}
+		return strings.TrimPrefix(stdout.String(), "Content-Type: text/plain\n\n")
+	}
+	tests := []struct {
+		method, path, expected string
+	}{
+		{"POST", "/echo", "200 POST hello 00-01020300000000000000000000000000-0405060000000000-01 request body"},
+		{"DELETE", "/echo", "-1"},
+		{"GET", "/large", "-3"},
+		{"GET", "/slow", "-2"},
+		{"GET", "/redirect", "-1"},
+	}
+	for _, tt := range tests {
+		if out := run(conf, tt.method, srv.URL+tt.path); out != tt.expected {
+			t.Error(tt.method, tt.path, out)
+		}
+	}
+	if out := run(conf, "GET", other.URL); out != "-1" {
+		t.Error("other", out)
+	}
+	conf.WasmHTTPAllow = nil
+	if out := run(conf, "GET", srv.URL+"/echo"); out != "-1" {
+		t.Error("no allowlist", out)
+	}
+}
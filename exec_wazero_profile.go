@@ -0,0 +1,266 @@
+//go:build wazero
+
+package main
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/pprof/profile"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// wasmProfile records execution of a module. listeners are called from the goroutine running the module
+type wasmProfile struct {
+	interval  time.Duration
+	stack     []string // function names, root first
+	hostStart []time.Time
+	hostCalls map[string]int
+	hostTime  map[string]time.Duration
+	samples   map[string]*wasmSample // keyed by joined stack
+	last      time.Time
+}
+
+type wasmSample struct {
+	stack []string
+	count int64
+	time  time.Duration
+}
+
+type wasmProfileKey struct{}
+
+// wasmProfileCacheSize is max profiled modules compiled. profiling is for a few scripts under investigation
+const wasmProfileCacheSize = 4
+
+// profileEnabled reports whether any script is profiled, by the option or per-route options.
+// listeners are set to the runtime only if enabled
+func profileEnabled(conf SrvConfig) bool {
+	if conf.WasmProfile {
+		return true
+	}
+	for _, rt := range conf.routes {
+		var tmp SrvConfig
+		if err := tmp.applyOptions(rt.Options); err == nil && tmp.WasmProfile {
+			return true
+		}
+	}
+	return false
+}
+
+func newWasmProfile(interval time.Duration) *wasmProfile {
+	return &wasmProfile{
+		interval:  max(interval, time.Millisecond),
+		hostCalls: map[string]int{},
+		hostTime:  map[string]time.Duration{},
+		samples:   map[string]*wasmSample{},
+		last:      time.Now(),
+	}
+}
+
+func wasmProfileFrom(ctx context.Context) *wasmProfile {
+	p, _ := ctx.Value(wasmProfileKey{}).(*wasmProfile)
+	return p
+}
+
+// tick attributes time since the last sample to current stack, once per interval
+func (p *wasmProfile) tick(now time.Time) {
+	elapsed := now.Sub(p.last)
+	if elapsed < p.interval || len(p.stack) == 0 {
+		return
+	}
+	key := strings.Join(p.stack, "\n")
+	s, ok := p.samples[key]
+	if !ok {
+		s = &wasmSample{stack: slices.Clone(p.stack)}
+		p.samples[key] = s
+	}
+	s.count++
+	s.time += elapsed
+	p.last = now
+}
+
+func (p *wasmProfile) push(name string) {
+	p.tick(time.Now())
+	p.stack = append(p.stack, name)
+}
+
+func (p *wasmProfile) pop() {
+	p.tick(time.Now())
+	if len(p.stack) != 0 {
+		p.stack = p.stack[:len(p.stack)-1]
+	}
+}
+
+// guestListener records calls of functions in the module
+type guestListener struct{}
+
+func (guestListener) Before(ctx context.Context, _ api.Module, def api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	if p := wasmProfileFrom(ctx); p != nil {
+		p.push(def.DebugName())
+	}
+}
+
+func (guestListener) After(ctx context.Context, _ api.Module, _ api.FunctionDefinition, _ []uint64) {
+	if p := wasmProfileFrom(ctx); p != nil {
+		p.pop()
+	}
+}
+
+func (l guestListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	l.After(ctx, mod, def, nil)
+}
+
+// hostListener records calls of host functions (WASI and httpcgi)
+type hostListener struct{}
+
+func (hostListener) Before(ctx context.Context, _ api.Module, def api.FunctionDefinition, _ []uint64, _ experimental.StackIterator) {
+	if p := wasmProfileFrom(ctx); p != nil {
+		p.push(def.DebugName())
+		p.hostCalls[def.DebugName()]++
+		p.hostStart = append(p.hostStart, time.Now())
+	}
+}
+
+func (hostListener) After(ctx context.Context, _ api.Module, def api.FunctionDefinition, _ []uint64) {
+	if p := wasmProfileFrom(ctx); p != nil && len(p.hostStart) != 0 {
+		p.hostTime[def.DebugName()] += time.Since(p.hostStart[len(p.hostStart)-1])
+		p.hostStart = p.hostStart[:len(p.hostStart)-1]
+		p.pop()
+	}
+}
+
+func (l hostListener) Abort(ctx context.Context, mod api.Module, def api.FunctionDefinition, _ error) {
+	l.After(ctx, mod, def, nil)
+}
+
+// listenerFactory returns the listener for every function
+func listenerFactory(l experimental.FunctionListener) experimental.FunctionListenerFactory {
+	return experimental.FunctionListenerFactoryFunc(func(api.FunctionDefinition) experimental.FunctionListener {
+		return l
+	})
+}
+
+// startProfile records the module if conf.WasmProfile. finish attaches the summary to the span and saves the profile
+func (runner *WazeroRunner) startProfile(conf SrvConfig, cmdname string, ctx context.Context) (context.Context, func()) {
+	if !conf.WasmProfile || runner.profCache == nil {
+		return ctx, func() {}
+	}
+	p := newWasmProfile(conf.WasmProfileInterval)
+	finish := func() {
+		summary := p.summary()
+		var hostCalls int
+		var hostTime time.Duration
+		for name, n := range p.hostCalls {
+			hostCalls += n
+			hostTime += p.hostTime[name]
+		}
+		span := trace.SpanFromContext(ctx)
+		span.SetAttributes(
+			attribute.Int("wasm.host_calls", hostCalls),
+			attribute.Int64("wasm.host_time_ns", hostTime.Nanoseconds()),
+			attribute.Int("wasm.samples", len(p.samples)))
+		span.AddEvent("wasm profile", trace.WithAttributes(attribute.StringSlice("host_calls", summary)))
+		slog.Info("wasm profile", "script", cmdname, "host_calls", hostCalls, "host_time", hostTime)
+		if conf.WasmProfileDir != "" {
+			if err := runner.saveProfile(conf, cmdname, p); err != nil {
+				slog.Error("save profile", "error", err, "script", cmdname)
+			}
+		}
+	}
+	return context.WithValue(ctx, wasmProfileKey{}, p), finish
+}
+
+// summary returns "name count time" of host calls, most time consuming first
+func (p *wasmProfile) summary() []string {
+	names := make([]string, 0, len(p.hostCalls))
+	for name := range p.hostCalls {
+		names = append(names, name)
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		return cmp.Compare(p.hostTime[b], p.hostTime[a])
+	})
+	res := []string{}
+	for _, name := range names {
+		res = append(res, fmt.Sprintf("%s %d %v", name, p.hostCalls[name], p.hostTime[name]))
+	}
+	return res
+}
+
+// profile converts samples into pprof
+func (p *wasmProfile) profile() *profile.Profile {
+	res := &profile.Profile{
+		SampleType: []*profile.ValueType{
+			{Type: "samples", Unit: "count"},
+			{Type: "time", Unit: "nanoseconds"},
+		},
+		PeriodType: &profile.ValueType{Type: "time", Unit: "nanoseconds"},
+		Period:     p.interval.Nanoseconds(),
+		TimeNanos:  time.Now().UnixNano(),
+	}
+	locations := map[string]*profile.Location{}
+	location := func(name string) *profile.Location {
+		if loc, ok := locations[name]; ok {
+			return loc
+		}
+		fn := &profile.Function{ID: uint64(len(res.Function) + 1), Name: name, SystemName: name}
+		res.Function = append(res.Function, fn)
+		loc := &profile.Location{ID: uint64(len(res.Location) + 1), Line: []profile.Line{{Function: fn}}}
+		res.Location = append(res.Location, loc)
+		locations[name] = loc
+		return loc
+	}
+	for _, s := range p.samples {
+		sample := &profile.Sample{Value: []int64{s.count, s.time.Nanoseconds()}}
+		// leaf first
+		for _, name := range slices.Backward(s.stack) {
+			sample.Location = append(sample.Location, location(name))
+		}
+		res.Sample = append(res.Sample, sample)
+		res.DurationNanos += s.time.Nanoseconds()
+	}
+	return res
+}
+
+// saveProfile merges the profile into the file of the script
+func (runner *WazeroRunner) saveProfile(conf SrvConfig, cmdname string, p *wasmProfile) error {
+	runner.profileMu.Lock()
+	defer runner.profileMu.Unlock()
+	filename := filepath.Join(conf.WasmProfileDir, strings.ReplaceAll(strings.Trim(cmdname, "/"), "/", "_")+".pprof")
+	prof := p.profile()
+	if fp, err := os.Open(filename); err == nil {
+		old, err := profile.Parse(fp)
+		fp.Close()
+		if err != nil {
+			slog.Warn("parse profile, overwrite", "error", err, "filename", filename)
+		} else if prof, err = profile.Merge([]*profile.Profile{old, prof}); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	fp, err := os.CreateTemp(conf.WasmProfileDir, ".pprof-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if err := prof.Write(fp); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	slog.Debug("profile saved", "filename", filename, "samples", len(prof.Sample))
+	return os.Rename(fp.Name(), filename)
+}
@@ -0,0 +1,144 @@
+//go:build wazero
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/pprof/profile"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// fibSrc is a module spending time in a function
+const fibSrc = `package main
+
+import "fmt"
+
+func fib(n int) int {
+	if n < 2 {
+		return n
+	}
+	return fib(n-1) + fib(n-2)
+}
+
+func main() {
+	fmt.Print("Content-Type: text/plain\n\n", fib(25))
+}
+`
+
+func TestWazeroProfile(t *testing.T) {
+	t.Parallel()
+	// enabled by a route
+	rconf := SrvConfig{}
+	rconf.routes = []routeConfig{{Path: "fib.wasm", Options: map[string]any{"wasm-profile": true}}}
+	runner, err := newWazeroRunner(rconf)
+	if err != nil {
+		t.Fatal("runtime", err)
+	}
+	if runner.profCache == nil {
+		t.Fatal("profiling disabled")
+	}
+	conf := SrvConfig{}
+	conf.Timeout = 30 * time.Second
+	conf.BaseDir = t.TempDir()
+	conf.WasmProfileDir = t.TempDir()
+	conf.WasmProfileInterval = time.Millisecond
+	buildWasm(t, filepath.Join(conf.BaseDir, "fib.wasm"), fibSrc)
+	run := func(conf SrvConfig) sdktrace.ReadOnlySpan {
+		sr := tracetest.NewSpanRecorder()
+		ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("").Start(context.Background(), "run")
+		stdout := &bytes.Buffer{}
+		if err := runner.Run(conf, "fib.wasm", map[string]string{}, io.NopCloser(&bytes.Buffer{}), stdout, &bytes.Buffer{}, ctx); err != nil {
+			t.Error("run", err)
+		}
+		span.End()
+		if stdout.String() != "Content-Type: text/plain\n\n75025" {
+			t.Error("output", stdout.String())
+		}
+		return sr.Ended()[0]
+	}
+	if span := run(conf); len(span.Attributes()) != 0 || len(span.Events()) != 0 {
+		t.Error("not profiled", span.Attributes(), span.Events())
+	}
+	conf.WasmProfile = true
+	var samples int64
+	for range 2 {
+		span := run(conf)
+		attrs := map[string]int64{}
+		for _, a := range span.Attributes() {
+			attrs[string(a.Key)] = a.Value.AsInt64()
+		}
+		if attrs["wasm.host_calls"] == 0 || attrs["wasm.host_time_ns"] == 0 || attrs["wasm.samples"] == 0 {
+			t.Error("attributes", attrs)
+		}
+		if events := span.Events(); len(events) != 1 || !slices.ContainsFunc(events[0].Attributes[0].Value.AsStringSlice(), func(s string) bool {
+			return strings.HasPrefix(s, "wasi_snapshot_preview1.fd_write 1 ")
+		}) {
+			t.Error("events", events)
+		}
+		fp, err := os.Open(filepath.Join(conf.WasmProfileDir, "fib.wasm.pprof"))
+		if err != nil {
+			t.Fatal("open profile", err)
+		}
+		prof, err := profile.Parse(fp)
+		fp.Close()
+		if err != nil {
+			t.Fatal("parse profile", err)
+		}
+		var total int64
+		for _, s := range prof.Sample {
+			total += s.Value[0]
+		}
+		if total <= samples {
+			t.Error("samples not merged", total, samples)
+		}
+		samples = total
+		if !slices.ContainsFunc(prof.Function, func(f *profile.Function) bool { return strings.HasSuffix(f.Name, "main.fib") }) {
+			t.Error("no main.fib in profile")
+		}
+	}
+}
+
+func TestWazeroProfileDisabled(t *testing.T) {
+	t.Parallel()
+	runner := newTestWazeroRunner(t)
+	if runner.profCache != nil {
+		t.Error("profiling enabled")
+	}
+	conf := SrvConfig{}
+	conf.Timeout = 30 * time.Second
+	conf.BaseDir = t.TempDir()
+	buildWasm(t, filepath.Join(conf.BaseDir, "fib.wasm"), fibSrc)
+	// not profiled if the runtime has no listener
+	conf.WasmProfile = true
+	sr := tracetest.NewSpanRecorder()
+	ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("").Start(context.Background(), "run")
+	stdout := &bytes.Buffer{}
+	if err := runner.Run(conf, "fib.wasm", map[string]string{}, io.NopCloser(&bytes.Buffer{}), stdout, &bytes.Buffer{}, ctx); err != nil {
+		t.Error("run", err)
+	}
+	span.End()
+	if stdout.String() != "Content-Type: text/plain\n\n75025" || len(sr.Ended()[0].Attributes()) != 0 {
+		t.Error("output", stdout.String(), sr.Ended()[0].Attributes())
+	}
+}
+
+func TestWasmProfileSummary(t *testing.T) {
+	t.Parallel()
+	p := newWasmProfile(time.Millisecond)
+	p.hostCalls = map[string]int{"short": 1, "long": 2, "none": 3}
+	// differences beyond int32 do not overflow
+	p.hostTime = map[string]time.Duration{"short": time.Nanosecond, "long": 10 * time.Second}
+	if res := p.summary(); !slices.Equal(res, []string{"long 2 10s", "short 1 1ns", "none 3 0s"}) {
+		t.Error("summary", res)
+	}
+}
@@ -2,8 +2,129 @@
 
 package main
 
-import "testing"
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
 
 func TestWazero(t *testing.T) {
-	testWasmAll(t, &WazeroRunner{})
+	testWasmAll(t, newTestWazeroRunner(t))
+}
+
+func TestWazeroWorkDir(t *testing.T) {
+	t.Parallel()
+	testWasmWorkDir(t, newTestWazeroRunner(t), func(t *testing.T, filename string) {
+		buildWasm(t, filename, readFileSrc)
+	})
+}
+
+func TestWazeroMemoryGrow(t *testing.T) {
+	t.Parallel()
+	testWasmMemoryGrow(t, newTestWazeroRunner(t))
+}
+
+func TestWazeroPreopen(t *testing.T) {
+	t.Parallel()
+	runner := newTestWazeroRunner(t)
+	if out, err := testWasmPreopen(t, runner, "rw"); out != "Content-Type: text/plain\n\ndata" || err != nil {
+		t.Error("rw", out, err)
+	}
+	if out, err := testWasmPreopen(t, runner, "ro"); out != "Content-Type: text/plain\n\ndata readonly" || err != nil {
+		t.Error("ro", out, err)
+	}
+}
+
+func TestWazeroStream(t *testing.T) {
+	t.Parallel()
+	testWasmStream(t, newTestWazeroRunner(t))
+}
+
+func TestWazeroScratch(t *testing.T) {
+	t.Parallel()
+	testWasmScratch(t, newTestWazeroRunner(t))
+}
+
+func newTestWazeroRunner(t *testing.T) *WazeroRunner {
+	runner, err := newWazeroRunner(SrvConfig{})
+	if err != nil {
+		t.Fatal("runtime", err)
+	}
+	return runner
+}
+
+func TestWazeroCompile(t *testing.T) {
+	t.Parallel()
+	testWasmCompile(t, func(conf SrvConfig) Runner {
+		runner, err := newWazeroRunner(conf)
+		if err != nil {
+			t.Fatal("runtime", err)
+		}
+		return runner
+	})
+}
+
+func TestWazeroBrokenArtifact(t *testing.T) {
+	t.Parallel()
+	conf := SrvConfig{}
+	conf.WasmCacheDir = t.TempDir()
+	runner, err := newWazeroRunner(conf)
+	if err != nil {
+		t.Fatal("runtime", err)
+	}
+	ctx := context.Background()
+	for _, module := range [][]byte{startWasm(), startWasm(0x41, 3, 0x10, 0)} {
+		if _, err := compileWazero(conf, runner.rt, ctx, module); err != nil {
+			t.Fatal("compile", err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(conf.WasmCacheDir, "wazero-*", "*"))
+	if err != nil || len(files) != 2 {
+		t.Fatal("artifacts", files, err)
+	}
+	slices.Sort(files)
+	artifacts := [][]byte{}
+	for _, fn := range files {
+		data, err := os.ReadFile(fn)
+		if err != nil {
+			t.Fatal("readfile", err)
+		}
+		if !validArtifact(data) {
+			t.Error("invalid", fn)
+		}
+		artifacts = append(artifacts, data)
+	}
+	// truncated one is removed and written again by new runtime. other one is kept
+	if err := os.WriteFile(files[0], artifacts[0][:len(artifacts[0])/2], 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	other, err := os.Stat(files[1])
+	if err != nil {
+		t.Fatal("stat", err)
+	}
+	runner, err = newWazeroRunner(conf)
+	if err != nil {
+		t.Fatal("runtime", err)
+	}
+	for _, module := range [][]byte{startWasm(), startWasm(0x41, 3, 0x10, 0)} {
+		if _, err := compileWazero(conf, runner.rt, ctx, module); err != nil {
+			t.Error("recompile", err)
+		}
+	}
+	if data, err := os.ReadFile(files[0]); err != nil || !bytes.Equal(data, artifacts[0]) {
+		t.Error("not recompiled", err)
+	}
+	if st, err := os.Stat(files[1]); err != nil || !os.SameFile(st, other) {
+		t.Error("valid artifact is replaced", err)
+	}
+	// invalid module does not touch the cache
+	if _, err := compileWazero(conf, runner.rt, ctx, []byte("not wasm")); err == nil {
+		t.Error("not wasm")
+	}
+	if n, err := removeBrokenArtifacts(conf.WasmCacheDir); n != 0 || err != nil {
+		t.Error("removed", n, err)
+	}
 }
@@ -0,0 +1,119 @@
+//go:build wazero
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// kvStore is key-value store of scripts persisted to a JSON file
+type kvStore struct {
+	mu       sync.Mutex
+	filename string
+	data     map[string]string
+}
+
+// openKVStore reads the file. missing file is an empty store
+func openKVStore(filename string) (*kvStore, error) {
+	res := &kvStore{filename: filename, data: map[string]string{}}
+	data, err := os.ReadFile(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return res, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &res.data); err != nil {
+		slog.Error("parse kv store", "error", err, "filename", filename)
+		return nil, err
+	}
+	return res, nil
+}
+
+func (kv *kvStore) Get(key string) (string, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	v, ok := kv.data[key]
+	return v, ok
+}
+
+func (kv *kvStore) Set(key, value string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	old, ok := kv.data[key]
+	kv.data[key] = value
+	if err := kv.save(); err != nil {
+		if ok {
+			kv.data[key] = old
+		} else {
+			delete(kv.data, key)
+		}
+		return err
+	}
+	return nil
+}
+
+func (kv *kvStore) Delete(key string) error {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+	old, ok := kv.data[key]
+	if !ok {
+		return nil
+	}
+	delete(kv.data, key)
+	if err := kv.save(); err != nil {
+		kv.data[key] = old
+		return err
+	}
+	return nil
+}
+
+// save writes the file atomically
+func (kv *kvStore) save() error {
+	data, err := json.Marshal(kv.data)
+	if err != nil {
+		return err
+	}
+	fp, err := os.CreateTemp(filepath.Dir(kv.filename), ".kv-*")
+	if err != nil {
+		slog.Error("save kv store", "error", err, "filename", kv.filename)
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), kv.filename)
+}
+
+// kvStores shares opened stores by filename
+type kvStores struct {
+	mu     sync.Mutex
+	stores map[string]*kvStore
+}
+
+func (s *kvStores) open(filename string) (*kvStore, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if kv, ok := s.stores[filename]; ok {
+		return kv, nil
+	}
+	kv, err := openKVStore(filename)
+	if err != nil {
+		return nil, err
+	}
+	if s.stores == nil {
+		s.stores = map[string]*kvStore{}
+	}
+	s.stores[filename] = kv
+	return kv, nil
+}
@@ -0,0 +1,53 @@
+//go:build wazero
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestKVStore(t *testing.T) {
+	t.Parallel()
+	filename := filepath.Join(t.TempDir(), "kv.json")
+	stores := kvStores{}
+	kv, err := stores.open(filename)
+	if err != nil {
+		t.Fatal("open", err)
+	}
+	if kv2, _ := stores.open(filename); kv2 != kv {
+		t.Error("not shared")
+	}
+	if _, ok := kv.Get("a"); ok {
+		t.Error("empty store has a")
+	}
+	if err := kv.Set("a", "1"); err != nil {
+		t.Error("set", err)
+	}
+	if err := kv.Set("b", "2"); err != nil {
+		t.Error("set", err)
+	}
+	if err := kv.Delete("b"); err != nil {
+		t.Error("delete", err)
+	}
+	if err := kv.Delete("c"); err != nil {
+		t.Error("delete missing", err)
+	}
+	reopened, err := openKVStore(filename)
+	if err != nil {
+		t.Fatal("reopen", err)
+	}
+	if v, ok := reopened.Get("a"); !ok || v != "1" {
+		t.Error("a", v, ok)
+	}
+	if _, ok := reopened.Get("b"); ok {
+		t.Error("b is not deleted")
+	}
+	if err := os.WriteFile(filename, []byte("broken"), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	if _, err := openKVStore(filename); err == nil {
+		t.Error("broken file")
+	}
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"sync"
+)
+
+// maxLogLine is max length of a line. longer line is split
+const maxLogLine = 64 * 1024
+
+// logWriter writes each line of stderr of the script to the log.
+// runner may write after Run returned, so it is guarded by mutex
+type logWriter struct {
+	logger *slog.Logger
+	mu     sync.Mutex
+	buf    []byte
+}
+
+// newLogWriter returns logWriter. args are attributes of each log
+func newLogWriter(args ...any) *logWriter {
+	return &logWriter{logger: slog.With(args...)}
+}
+
+// With returns new logWriter with additional attributes
+func (lw *logWriter) With(args ...any) *logWriter {
+	return &logWriter{logger: lw.logger.With(args...)}
+}
+
+func (lw *logWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.buf = append(lw.buf, p...)
+	for {
+		i := bytes.IndexByte(lw.buf, '\n')
+		if i < 0 {
+			break
+		}
+		lw.logger.Info("stderr", "message", string(bytes.TrimSuffix(lw.buf[:i], []byte("\r"))))
+		lw.buf = lw.buf[i+1:]
+	}
+	if len(lw.buf) >= maxLogLine {
+		lw.flush()
+	}
+	return len(p), nil
+}
+
+// Close writes rest of the line
+func (lw *logWriter) Close() error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.flush()
+	return nil
+}
+
+func (lw *logWriter) flush() {
+	if len(lw.buf) != 0 {
+		lw.logger.Info("stderr", "message", string(lw.buf))
+		lw.buf = nil
+	}
+}
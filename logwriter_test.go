@@ -0,0 +1,36 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestLogWriter(t *testing.T) {
+	t.Parallel()
+	buf := &bytes.Buffer{}
+	lw := &logWriter{logger: slog.New(slog.NewJSONHandler(buf, nil)).With("script", "test.cgi")}
+	lw = lw.With("container", "id123")
+	lw.Write([]byte("line1\nli"))
+	lw.Write([]byte("ne2\r\nrest"))
+	lw.Write([]byte(strings.Repeat("x", maxLogLine)))
+	lw.Close()
+	lw.Close()
+	expected := []string{"line1", "line2", "rest" + strings.Repeat("x", maxLogLine)}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != len(expected) {
+		t.Error("lines", len(lines), lines)
+		return
+	}
+	for i, line := range lines {
+		var rec map[string]any
+		if err := json.Unmarshal([]byte(line), &rec); err != nil {
+			t.Error("json", err)
+		}
+		if rec["msg"] != "stderr" || rec["message"] != expected[i] || rec["script"] != "test.cgi" || rec["container"] != "id123" {
+			t.Error("record", i, rec)
+		}
+	}
+}
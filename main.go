@@ -26,7 +26,14 @@ var (
 type cgiHandler struct{}
 
 func main() {
-	args, err := flags.ParseArgs(&opts, os.Args)
+	var compileCmd compileCommand
+	parser := flags.NewParser(&opts, flags.Default)
+	parser.SubcommandsOptional = true
+	if _, err := parser.AddCommand("compile", "compile scripts ahead of time",
+		"compile every script under base-dir into the cache of the runner (--wasm-cache-dir)", &compileCmd); err != nil {
+		panic(err)
+	}
+	args, err := parser.ParseArgs(os.Args[1:])
 	if opts.Version {
 		fmt.Println("httpcgi version", version, "commit", commit, "build", date)
 		fmt.Println("runners:", reflect.ValueOf(runnerMap).MapKeys())
@@ -51,6 +58,18 @@ func main() {
 	if err != nil {
 		return
 	}
+	if opts.Subreaper || os.Getpid() == 1 {
+		if reaper, err = startReaper(opts.Subreaper); err != nil {
+			slog.Error("reaper", "error", err)
+			return
+		}
+	}
+	if opts.RouteConfig != "" {
+		if err := opts.loadRoutes(opts.RouteConfig); err != nil {
+			slog.Error("route config", "error", err)
+			return
+		}
+	}
 	runnerFn, ok := runnerMap[opts.Runner]
 	if !ok {
 		slog.Warn("unknown runner", "runner", opts.Runner, "available", reflect.ValueOf(runnerMap).MapKeys())
@@ -70,6 +89,13 @@ func main() {
 	if err != nil {
 		slog.Error("abs", "error", err)
 	}
+	if parser.Active != nil && parser.Active.Name == "compile" {
+		if err := compileScripts(opts, runner); err != nil {
+			slog.Error("compile", "error", err)
+			os.Exit(1)
+		}
+		return
+	}
 	switch opts.OtelProvider {
 
 	case "stdout":
@@ -100,6 +126,17 @@ func main() {
 			&mux, "httpcgi", otelhttp.WithMessageEvents(otelhttp.ReadEvents, otelhttp.WriteEvents))
 	}
 	http.Handle(opts.Prefix, hdl)
+	if opts.AdminPath != "" {
+		if ar, ok := runner.(AdminRunner); ok {
+			// admin view has no authentication. serve it on separate loopback listener
+			if err := serveAdmin(opts.AdminAddr, opts.AdminPath, ar.AdminHandler()); err != nil {
+				slog.Error("admin listen", "error", err)
+				return
+			}
+		} else {
+			slog.Warn("admin view not supported", "runner", opts.Runner)
+		}
+	}
 
 	server := http.Server{
 		Addr:    opts.Addr,
@@ -0,0 +1,186 @@
+//go:build linux
+
+package main
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// childReaper reaps orphaned processes adopted by httpcgi (as PID 1 or subreaper).
+// commands started by Start are left to exec.Cmd.Wait
+type childReaper struct {
+	mu      sync.Mutex
+	managed map[int]struct{}
+}
+
+// reaper is nil if reaping is disabled
+var reaper *childReaper
+
+func newChildReaper(subreaper bool) (*childReaper, error) {
+	if subreaper {
+		if err := unix.Prctl(unix.PR_SET_CHILD_SUBREAPER, 1, 0, 0, 0); err != nil {
+			slog.Error("set subreaper", "error", err)
+			return nil, err
+		}
+	}
+	return &childReaper{managed: map[int]struct{}{}}, nil
+}
+
+// startReaper starts reaping on SIGCHLD and periodically
+func startReaper(subreaper bool) (*childReaper, error) {
+	res, err := newChildReaper(subreaper)
+	if err != nil {
+		return nil, err
+	}
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGCHLD)
+	go func() {
+		tick := time.NewTicker(10 * time.Second)
+		defer tick.Stop()
+		for {
+			select {
+			case <-ch:
+				res.reap(false)
+			case <-tick.C:
+				// zombies behind managed children
+				res.reap(true)
+			}
+		}
+	}()
+	slog.Info("reaper started", "pid", os.Getpid(), "subreaper", subreaper)
+	return res, nil
+}
+
+// Start starts the command and marks it as managed
+func (r *childReaper) Start(cmd *exec.Cmd) error {
+	if r == nil {
+		return cmd.Start()
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	r.managed[cmd.Process.Pid] = struct{}{}
+	return nil
+}
+
+// Release unmarks the command, and reaps children which exited after it. call after exec.Cmd.Wait
+func (r *childReaper) Release(cmd *exec.Cmd) {
+	if r == nil || cmd.Process == nil {
+		return
+	}
+	r.mu.Lock()
+	delete(r.managed, cmd.Process.Pid)
+	r.mu.Unlock()
+	r.reap(false)
+}
+
+// siginfoChild is the head of siginfo_t for child status. the union is aligned to pointer
+type siginfoChild struct {
+	signo, errno, code int32
+	_                  [0]uintptr
+	pid                int32
+}
+
+// exitedChild returns pid of a child which exited, without reaping it. 0 if none
+func exitedChild() int {
+	var info unix.Siginfo
+	if err := unix.Waitid(unix.P_ALL, 0, &info, unix.WEXITED|unix.WNOHANG|unix.WNOWAIT, nil); err != nil {
+		// ECHILD: no children
+		return 0
+	}
+	return int((*siginfoChild)(unsafe.Pointer(&info)).pid)
+}
+
+// zombieChildren lists zombie children of this process from /proc
+func zombieChildren() []int {
+	self := os.Getpid()
+	res := []int{}
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		slog.Error("read /proc", "error", err)
+		return res
+	}
+	for _, ent := range entries {
+		pid, err := strconv.Atoi(ent.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := os.ReadFile(filepath.Join("/proc", ent.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+		// pid (comm) state ppid ...
+		idx := bytes.LastIndexByte(stat, ')')
+		if idx < 0 {
+			continue
+		}
+		fields := bytes.Fields(stat[idx+1:])
+		if len(fields) < 2 || string(fields[0]) != "Z" {
+			continue
+		}
+		if ppid, err := strconv.Atoi(string(fields[1])); err == nil && ppid == self {
+			res = append(res, pid)
+		}
+	}
+	return res
+}
+
+// reap waits zombie children which are not managed. returns number of reaped processes.
+// exit status of managed children is left to exec.Cmd.Wait: exited children are peeked until a managed one,
+// and with scan, other zombies are looked up from /proc
+func (r *childReaper) reap(scan bool) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	cnt := 0
+	for {
+		pid := exitedChild()
+		if pid == 0 {
+			return cnt
+		}
+		if _, ok := r.managed[pid]; ok {
+			break
+		}
+		if !r.wait(pid) {
+			return cnt
+		}
+		cnt++
+	}
+	if !scan {
+		return cnt
+	}
+	for _, pid := range zombieChildren() {
+		if _, ok := r.managed[pid]; ok {
+			continue
+		}
+		if r.wait(pid) {
+			cnt++
+		}
+	}
+	return cnt
+}
+
+// wait reaps the child. r.mu must be held
+func (r *childReaper) wait(pid int) bool {
+	var ws syscall.WaitStatus
+	wpid, err := syscall.Wait4(pid, &ws, syscall.WNOHANG, nil)
+	if err != nil || wpid != pid {
+		slog.Debug("wait4", "pid", pid, "error", err)
+		return false
+	}
+	slog.Debug("reaped", "pid", pid, "status", ws.ExitStatus())
+	return true
+}
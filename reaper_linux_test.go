@@ -0,0 +1,96 @@
+//go:build linux
+
+package main
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitZombie(t *testing.T, pid int) {
+	for range 100 {
+		if slices.Contains(zombieChildren(), pid) {
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("not zombie", pid)
+}
+
+// reaperTestEnv is set to the subprocess running TestReaper
+const reaperTestEnv = "HTTPCGI_TEST_REAPER"
+
+// runs in a subprocess: subreaper remains set to the process, and reaper may reap children of other tests
+func TestReaper(t *testing.T) {
+	if os.Getenv(reaperTestEnv) == "" {
+		t.Parallel()
+		cmd := exec.Command(os.Args[0], "-test.run=^TestReaper$", "-test.v")
+		cmd.Env = append(os.Environ(), reaperTestEnv+"=1")
+		out, err := cmd.CombinedOutput()
+		if err != nil || !strings.Contains(string(out), "--- PASS: TestReaper") {
+			t.Error("subprocess", err, string(out))
+		}
+		return
+	}
+	r, err := newChildReaper(true)
+	if err != nil {
+		t.Fatal("subreaper", err)
+	}
+	out, err := exec.Command("/bin/sh", "-c", "sleep 0.1 >/dev/null & echo $!").Output()
+	if err != nil {
+		t.Fatal("exec", err)
+	}
+	orphan, err := strconv.Atoi(strings.TrimSpace(string(out)))
+	if err != nil {
+		t.Fatal("pid", err)
+	}
+	waitZombie(t, orphan)
+	cmd := exec.Command("/bin/sh", "-c", "exit 3")
+	if err := r.Start(cmd); err != nil {
+		t.Fatal("start", err)
+	}
+	waitZombie(t, cmd.Process.Pid)
+	if cnt := r.reap(true); cnt != 1 {
+		t.Error("reaped", cnt)
+	}
+	if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(orphan))); err == nil {
+		t.Error("orphan still exists", orphan)
+	}
+	var exitErr *exec.ExitError
+	if err := cmd.Wait(); !errors.As(err, &exitErr) || exitErr.ExitCode() != 3 {
+		t.Error("managed process", err)
+	}
+	r.Release(cmd)
+	if len(r.managed) != 0 {
+		t.Error("managed", r.managed)
+	}
+	// orphan behind managed zombie is reaped when it is released
+	cmd = exec.Command("/bin/sh", "-c", "exit 0")
+	if err := r.Start(cmd); err != nil {
+		t.Fatal("start", err)
+	}
+	waitZombie(t, cmd.Process.Pid)
+	out, err = exec.Command("/bin/sh", "-c", "sleep 0.1 >/dev/null & echo $!").Output()
+	if err != nil {
+		t.Fatal("exec", err)
+	}
+	if orphan, err = strconv.Atoi(strings.TrimSpace(string(out))); err != nil {
+		t.Fatal("pid", err)
+	}
+	waitZombie(t, orphan)
+	r.reap(false)
+	if err := cmd.Wait(); err != nil {
+		t.Error("managed process", err)
+	}
+	r.Release(cmd)
+	if _, err := os.Stat(filepath.Join("/proc", strconv.Itoa(orphan))); err == nil {
+		t.Error("orphan still exists after release", orphan)
+	}
+}
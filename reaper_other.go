@@ -0,0 +1,30 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"os/exec"
+)
+
+// childReaper is not supported on this platform
+type childReaper struct{}
+
+// reaper is always nil
+var reaper *childReaper
+
+func startReaper(subreaper bool) (*childReaper, error) {
+	if subreaper {
+		return nil, fmt.Errorf("subreaper is not supported")
+	}
+	return nil, nil
+}
+
+// Start starts the command
+func (r *childReaper) Start(cmd *exec.Cmd) error {
+	return cmd.Start()
+}
+
+// Release does nothing
+func (r *childReaper) Release(cmd *exec.Cmd) {
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"reflect"
+
+	"github.com/jessevdk/go-flags"
+)
+
+// routeConfig overrides options for the scripts matching Path.
+// Options are keyed by long option name, the value is string, number, bool or list of them.
+type routeConfig struct {
+	Path    string         `json:"path"`
+	Options map[string]any `json:"options"`
+}
+
+// optionValues converts option value in route config to list of strings
+func optionValues(val any) []string {
+	switch v := val.(type) {
+	case []any:
+		res := []string{}
+		for _, i := range v {
+			res = append(res, optionValues(i)...)
+		}
+		return res
+	case string:
+		return []string{v}
+	default:
+		return []string{fmt.Sprint(v)}
+	}
+}
+
+// loadRoutes reads per-route configuration file
+func (conf *SrvConfig) loadRoutes(filename string) error {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		slog.Error("read route config", "error", err, "filename", filename)
+		return err
+	}
+	var routes []routeConfig
+	if err := json.Unmarshal(data, &routes); err != nil {
+		slog.Error("parse route config", "error", err, "filename", filename)
+		return err
+	}
+	for _, rt := range routes {
+		if _, err := path.Match(rt.Path, ""); err != nil {
+			return fmt.Errorf("invalid path pattern %s: %w", rt.Path, err)
+		}
+		var tmp SrvConfig
+		if err := tmp.applyOptions(rt.Options); err != nil {
+			return fmt.Errorf("route %s: %w", rt.Path, err)
+		}
+	}
+	conf.routes = routes
+	slog.Debug("routes loaded", "filename", filename, "routes", len(routes))
+	return nil
+}
+
+// applyOptions sets options by long name
+func (conf *SrvConfig) applyOptions(options map[string]any) error {
+	parser := flags.NewParser(conf, flags.None)
+	cv := reflect.ValueOf(conf).Elem()
+	for name, val := range options {
+		opt := parser.FindOptionByLongName(name)
+		if opt == nil {
+			return fmt.Errorf("unknown option %s", name)
+		}
+		// values are appended to the global list. do not share its backing array
+		if fv := cv.FieldByName(opt.Field().Name); fv.Kind() == reflect.Slice {
+			fv.Set(fv.Slice3(0, fv.Len(), fv.Len()))
+		}
+		for _, v := range optionValues(val) {
+			if err := opt.Set(&v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// ForScript returns configuration with options of matching routes applied in order
+func (conf SrvConfig) ForScript(script string) (SrvConfig, error) {
+	res := conf
+	for _, rt := range conf.routes {
+		if ok, _ := path.Match(rt.Path, script); !ok {
+			continue
+		}
+		slog.Debug("route matched", "path", rt.Path, "script", script)
+		if err := res.applyOptions(rt.Options); err != nil {
+			return conf, err
+		}
+	}
+	return res, nil
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestRouteConfig(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(t.TempDir(), "routes.json")
+	content := `[
+	{"path": "reports/*", "options": {"idle-timeout": "5m", "timeout": "1h"}},
+	{"path": "reports/slow.cgi", "options": {"header-timeout": "10s", "timeout": "2h"}}
+]`
+	if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	conf := SrvConfig{}
+	conf.Timeout = time.Minute
+	if err := conf.loadRoutes(fname); err != nil {
+		t.Fatal("load", err)
+	}
+	res, err := conf.ForScript("hello.cgi")
+	if err != nil {
+		t.Error("error", err)
+	}
+	if res.Timeout != time.Minute || res.IdleTimeout != 0 {
+		t.Error("not match", res.Timeout, res.IdleTimeout)
+	}
+	res, err = conf.ForScript("reports/daily.cgi")
+	if err != nil {
+		t.Error("error", err)
+	}
+	if res.Timeout != time.Hour || res.IdleTimeout != 5*time.Minute || res.HeaderTimeout != 0 {
+		t.Error("match", res.Timeout, res.IdleTimeout, res.HeaderTimeout)
+	}
+	res, err = conf.ForScript("reports/slow.cgi")
+	if err != nil {
+		t.Error("error", err)
+	}
+	if res.Timeout != 2*time.Hour || res.IdleTimeout != 5*time.Minute || res.HeaderTimeout != 10*time.Second {
+		t.Error("match2", res.Timeout, res.IdleTimeout, res.HeaderTimeout)
+	}
+	if conf.Timeout != time.Minute {
+		t.Error("global changed", conf.Timeout)
+	}
+}
+
+func TestRouteConfigList(t *testing.T) {
+	t.Parallel()
+	fname := filepath.Join(t.TempDir(), "routes.json")
+	content := `[
+	{"path": "a/*", "options": {"env": ["A=1", "B=2"]}},
+	{"path": "*/x", "options": {"env": "C=3"}}
+]`
+	if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	conf := SrvConfig{}
+	conf.Env = make([]string, 1, 10)
+	conf.Env[0] = "G=0"
+	if err := conf.loadRoutes(fname); err != nil {
+		t.Fatal("load", err)
+	}
+	res1, err := conf.ForScript("a/x")
+	if err != nil {
+		t.Error("error", err)
+	}
+	res2, err := conf.ForScript("b/x")
+	if err != nil {
+		t.Error("error", err)
+	}
+	if !slices.Equal(res1.Env, []string{"G=0", "A=1", "B=2", "C=3"}) {
+		t.Error("a/x", res1.Env)
+	}
+	if !slices.Equal(res2.Env, []string{"G=0", "C=3"}) {
+		t.Error("b/x", res2.Env)
+	}
+	if !slices.Equal(conf.Env, []string{"G=0"}) {
+		t.Error("global", conf.Env)
+	}
+}
+
+func TestRouteConfigError(t *testing.T) {
+	t.Parallel()
+	contents := map[string]string{
+		"unknown": `[{"path": "*", "options": {"no-such-option": "1"}}]`,
+		"value":   `[{"path": "*", "options": {"timeout": "abc"}}]`,
+		"pattern": `[{"path": "[", "options": {}}]`,
+		"json":    `{"path": "*"}`,
+	}
+	for name, content := range contents {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			fname := filepath.Join(t.TempDir(), "routes.json")
+			if err := os.WriteFile(fname, []byte(content), 0644); err != nil {
+				t.Fatal("writefile", err)
+			}
+			conf := SrvConfig{}
+			if err := conf.loadRoutes(fname); err == nil {
+				t.Error("no error")
+			}
+		})
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// ErrScratchQuota is the cause of cancellation when the script uses too much TMPDIR
+var ErrScratchQuota = errors.New("scratch quota exceeded")
+
+type scratchDirKey struct{}
+
+// withScratchDir stores per-request temporary directory in the context
+func withScratchDir(ctx context.Context, dir string) context.Context {
+	return context.WithValue(ctx, scratchDirKey{}, dir)
+}
+
+// scratchDir returns per-request temporary directory. empty if not exists
+func scratchDir(ctx context.Context) string {
+	if dir, ok := ctx.Value(scratchDirKey{}).(string); ok {
+		return dir
+	}
+	return ""
+}
+
+// dirSize returns total size of regular files under the directory
+func dirSize(dir string) int64 {
+	var res int64
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if d.Type().IsRegular() {
+			if fi, err := d.Info(); err == nil {
+				res += fi.Size()
+			}
+		}
+		return nil
+	})
+	return res
+}
+
+// watchScratchQuota cancels the execution when the directory exceeds quota
+func watchScratchQuota(ctx context.Context, dir string, quota ByteSize, interval time.Duration,
+	cancel context.CancelCauseFunc) {
+	tick := time.NewTicker(interval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+			if size := dirSize(dir); size > int64(quota) {
+				slog.Warn("scratch quota exceeded", "dir", dir, "size", size, "quota", quota)
+				cancel(fmt.Errorf("%w %d > %d", ErrScratchQuota, size, quota))
+				return
+			}
+		}
+	}
+}
+
+// removeScratchDir removes the directory. files may be read-only
+func removeScratchDir(dir string) {
+	filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err == nil && d.IsDir() {
+			os.Chmod(path, 0700)
+		}
+		return nil
+	})
+	if err := os.RemoveAll(dir); err != nil {
+		slog.Error("remove scratch dir", "error", err, "dir", dir)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestDirSize(t *testing.T) {
+	t.Parallel()
+	tmpd := t.TempDir()
+	if err := os.Mkdir(filepath.Join(tmpd, "sub"), 0755); err != nil {
+		t.Fatal("mkdir", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpd, "a"), make([]byte, 100), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpd, "sub", "b"), make([]byte, 200), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	if size := dirSize(tmpd); size != 300 {
+		t.Error("size", size)
+	}
+}
+
+func TestScratchQuota(t *testing.T) {
+	t.Parallel()
+	tmpd := t.TempDir()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	defer cancel(nil)
+	go watchScratchQuota(ctx, tmpd, 100, 10*time.Millisecond, cancel)
+	time.Sleep(30 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Error("cancelled", context.Cause(ctx))
+	}
+	if err := os.WriteFile(filepath.Join(tmpd, "a"), make([]byte, 101), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("not cancelled")
+	}
+	if !errors.Is(context.Cause(ctx), ErrScratchQuota) {
+		t.Error("cause", context.Cause(ctx))
+	}
+}
+
+func TestRemoveScratchDir(t *testing.T) {
+	t.Parallel()
+	tmpd, err := os.MkdirTemp("", "")
+	if err != nil {
+		t.Fatal("tmpdir", err)
+	}
+	if err := os.Mkdir(filepath.Join(tmpd, "ro"), 0755); err != nil {
+		t.Fatal("mkdir", err)
+	}
+	if err := os.WriteFile(filepath.Join(tmpd, "ro", "a"), []byte("a"), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	if err := os.Chmod(filepath.Join(tmpd, "ro"), 0500); err != nil {
+		t.Fatal("chmod", err)
+	}
+	removeScratchDir(tmpd)
+	if _, err := os.Stat(tmpd); !os.IsNotExist(err) {
+		t.Error("not removed", err)
+	}
+}
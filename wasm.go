@@ -0,0 +1,335 @@
+//go:build wazero || wasmtime || wasmer
+
+package main
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"maps"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"golang.org/x/sync/singleflight"
+)
+
+// wasmPreopen is a host directory mapped into WASI guest
+type wasmPreopen struct {
+	Host     string
+	Guest    string
+	ReadOnly bool
+}
+
+// UnmarshalFlag implements flags.Unmarshaler. format is host:guest[:ro|rw]
+func (p *wasmPreopen) UnmarshalFlag(value string) error {
+	parts := strings.Split(value, ":")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("invalid preopen %s: expected host:guest[:ro]", value)
+	}
+	p.Host, p.Guest, p.ReadOnly = parts[0], parts[1], false
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			p.ReadOnly = true
+		case "rw":
+		default:
+			return fmt.Errorf("invalid preopen mode %s", parts[2])
+		}
+	}
+	return nil
+}
+
+// wasmHTTPAllow is an entry of outbound HTTP allowlist. format is [METHOD,...=]scheme://host[:port]
+type wasmHTTPAllow struct {
+	Methods []string // empty allows any method
+	Origin  string
+}
+
+// UnmarshalFlag implements flags.Unmarshaler
+func (a *wasmHTTPAllow) UnmarshalFlag(value string) error {
+	a.Methods = nil
+	origin := value
+	if methods, rest, ok := strings.Cut(value, "="); ok {
+		for m := range strings.SplitSeq(methods, ",") {
+			a.Methods = append(a.Methods, strings.ToUpper(m))
+		}
+		origin = rest
+	}
+	u, err := url.Parse(origin)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || strings.Trim(u.Path, "/") != "" {
+		return fmt.Errorf("invalid allowed host %s: expected [METHOD,...=]scheme://host[:port]", value)
+	}
+	a.Origin = httpOrigin(u)
+	return nil
+}
+
+// httpOrigin returns scheme://host[:port] without default port
+func httpOrigin(u *url.URL) string {
+	host := strings.ToLower(u.Host)
+	switch {
+	case u.Scheme == "http" && u.Port() == "80", u.Scheme == "https" && u.Port() == "443":
+		host = strings.ToLower(u.Hostname())
+	}
+	return u.Scheme + "://" + host
+}
+
+// wasmPreopens returns directories to preopen for the module.
+// configured preopens override the default ones of the same guest path
+func wasmPreopens(conf SrvConfig, cmdname string, ctx context.Context) []wasmPreopen {
+	res := []wasmPreopen{}
+	if dir := workDir(conf, cmdname); dir != "" {
+		// first preopen is the working directory of Go guests
+		res = append(res, wasmPreopen{Host: dir, Guest: "."})
+	}
+	if dir := scratchDir(ctx); dir != "" {
+		res = append(res, wasmPreopen{Host: dir, Guest: "/tmp"})
+	}
+	for _, p := range conf.WasmPreopen {
+		res = slices.DeleteFunc(res, func(q wasmPreopen) bool { return q.Guest == p.Guest })
+		res = append(res, p)
+	}
+	return res
+}
+
+// writablePreopens returns error if any of preopens is read-only.
+// for runtimes which cannot mount directory read-only
+func writablePreopens(preopens []wasmPreopen, runtime string) error {
+	for _, p := range preopens {
+		if p.ReadOnly {
+			return fmt.Errorf("read-only preopen is not supported by %s (use wazero): %s", runtime, p.Guest)
+		}
+	}
+	return nil
+}
+
+// checkPreopens rejects read-only preopen of the option or per-route options at startup,
+// for runtimes which cannot mount directory read-only
+func checkPreopens(conf SrvConfig, runtime string) error {
+	if err := writablePreopens(conf.WasmPreopen, runtime); err != nil {
+		return err
+	}
+	for _, rt := range conf.routes {
+		var tmp SrvConfig
+		if err := tmp.applyOptions(rt.Options); err != nil {
+			return fmt.Errorf("route %s: %w", rt.Path, err)
+		}
+		if err := writablePreopens(tmp.WasmPreopen, runtime); err != nil {
+			return fmt.Errorf("route %s: %w", rt.Path, err)
+		}
+	}
+	return nil
+}
+
+// wasmDeadline applies conf.Timeout to the module. the runtime interrupts the module when ctx is done
+func wasmDeadline(conf SrvConfig, ctx context.Context) (context.Context, context.CancelFunc) {
+	if conf.Timeout > 0 {
+		return context.WithTimeoutCause(ctx, conf.Timeout, fmt.Errorf("%w %v", ErrTimeout, conf.Timeout))
+	}
+	return context.WithCancel(ctx)
+}
+
+// wasmResult returns error of Runner.Run from the result of the module.
+// exited is true if the module called proc_exit, and code 0 is success even if it is returned as an error.
+// other errors are traps, logged and recorded to the span with WASM stack trace
+func wasmResult(ctx context.Context, err error, code int, exited bool, stack string) error {
+	if exited {
+		if code == 0 {
+			return nil
+		}
+		slog.Warn("exit", "code", code)
+		return ExitCodeError{Code: code}
+	}
+	if err == nil {
+		return nil
+	}
+	if stack == "" {
+		slog.Error("wasm error", "error", err)
+		return err
+	}
+	slog.Error("trap", "error", err, "stack", stack)
+	trace.SpanFromContext(ctx).AddEvent("trap", trace.WithAttributes(
+		attribute.String("error", err.Error()), attribute.String("stack", stack)))
+	return err
+}
+
+// wasmEnv returns environment variables seen from the guest
+func wasmEnv(envvar map[string]string, ctx context.Context) map[string]string {
+	res := maps.Clone(envvar)
+	if scratchDir(ctx) != "" {
+		res["TMPDIR"] = "/tmp"
+	}
+	return res
+}
+
+// artifactCache wraps compile to persist serialized modules in dir, keyed by hash of the bytecode.
+// artifact is loaded if valid accepts it, otherwise (e.g. compiled by other version of the runtime) recompiled
+func artifactCache(dir, runtime string, compile func([]byte) ([]byte, error), valid func([]byte) error) func([]byte) ([]byte, error) {
+	if dir == "" {
+		return compile
+	}
+	return func(bytecode []byte) ([]byte, error) {
+		sum := sha256.Sum256(bytecode)
+		filename := filepath.Join(dir, hex.EncodeToString(sum[:])+"."+runtime)
+		if data, err := os.ReadFile(filename); err == nil {
+			if err = valid(data); err == nil {
+				slog.Debug("artifact loaded", "filename", filename)
+				return data, nil
+			}
+			slog.Warn("invalid artifact, recompile", "error", err, "filename", filename)
+		}
+		data, err := compile(bytecode)
+		if err != nil {
+			return nil, err
+		}
+		if err := saveArtifact(filename, data); err != nil {
+			slog.Error("save artifact", "error", err, "filename", filename)
+			return nil, err
+		}
+		return data, nil
+	}
+}
+
+// saveArtifact writes the file atomically
+func saveArtifact(filename string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0o755); err != nil {
+		return err
+	}
+	fp, err := os.CreateTemp(filepath.Dir(filename), ".artifact-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fp.Name())
+	if _, err := fp.Write(data); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(fp.Name(), filename)
+}
+
+// moduleCache is LRU cache of compiled modules keyed by path and memory limit.
+// entry is recompiled when mtime or size of the file changes
+type moduleCache[T any] struct {
+	mu      sync.Mutex
+	size    int
+	lru     *list.List // front is most recently used
+	entries map[moduleKey]*list.Element
+	compile func(bytecode []byte) (T, error)
+	evict   func(T) // nil if nothing to release
+	group   singleflight.Group
+}
+
+type moduleKey struct {
+	path  string
+	pages uint32 // memory limit, 0 is unlimited
+}
+
+type moduleEntry[T any] struct {
+	key   moduleKey
+	mtime time.Time
+	size  int64
+	value T
+}
+
+func newModuleCache[T any](size int, compile func([]byte) (T, error), evict func(T)) *moduleCache[T] {
+	return &moduleCache[T]{
+		size:    max(size, 1),
+		lru:     list.New(),
+		entries: map[moduleKey]*list.Element{},
+		compile: compile,
+		evict:   evict,
+	}
+}
+
+// get returns compiled module of the file, with linear memory limited to pages
+func (c *moduleCache[T]) get(path string, pages uint32) (T, error) {
+	var zero T
+	key := moduleKey{path: path, pages: pages}
+	st, err := os.Stat(path)
+	if err != nil {
+		slog.Error("stat module", "error", err, "filename", path)
+		c.remove(key)
+		return zero, err
+	}
+	c.mu.Lock()
+	if el, ok := c.entries[key]; ok {
+		ent := el.Value.(*moduleEntry[T])
+		if ent.mtime.Equal(st.ModTime()) && ent.size == st.Size() {
+			c.lru.MoveToFront(el)
+			c.mu.Unlock()
+			return ent.value, nil
+		}
+	}
+	c.mu.Unlock()
+	// concurrent requests of the same module wait for one compilation
+	v, err, _ := c.group.Do(fmt.Sprintf("%s\x00%d", path, pages), func() (any, error) {
+		return c.load(key, st)
+	})
+	if err != nil {
+		return zero, err
+	}
+	return v.(T), nil
+}
+
+// load compiles the file and adds it to the cache
+func (c *moduleCache[T]) load(key moduleKey, st os.FileInfo) (T, error) {
+	var zero T
+	bytecode, err := os.ReadFile(key.path)
+	if err != nil {
+		slog.Error("read bytecode", "error", err, "filename", key.path)
+		return zero, err
+	}
+	slog.Debug("bytecode read", "length", len(bytecode), "filename", key.path)
+	if key.pages != 0 {
+		if bytecode, err = limitMemory(bytecode, key.pages); err != nil {
+			slog.Error("limit memory", "error", err, "filename", key.path, "pages", key.pages)
+			return zero, err
+		}
+	}
+	start := time.Now()
+	value, err := c.compile(bytecode)
+	if err != nil {
+		slog.Error("compile", "error", err, "filename", key.path)
+		return zero, err
+	}
+	slog.Info("compiled", "filename", key.path, "elapsed", time.Since(start))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.drop(el)
+	}
+	c.entries[key] = c.lru.PushFront(&moduleEntry[T]{key: key, mtime: st.ModTime(), size: st.Size(), value: value})
+	for c.lru.Len() > c.size {
+		c.drop(c.lru.Back())
+	}
+	return value, nil
+}
+
+func (c *moduleCache[T]) remove(key moduleKey) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.drop(el)
+	}
+}
+
+// drop removes the entry. c.mu must be held
+func (c *moduleCache[T]) drop(el *list.Element) {
+	ent := c.lru.Remove(el).(*moduleEntry[T])
+	delete(c.entries, ent.key)
+	if c.evict != nil {
+		c.evict(ent.value)
+	}
+}
@@ -0,0 +1,205 @@
+//go:build wazero || wasmtime || wasmer
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// wasmPageSize is size of a page of WebAssembly linear memory
+const wasmPageSize = 65536
+
+const (
+	wasmSectionImport = 2
+	wasmSectionMemory = 5
+)
+
+// ErrMemoryLimit is returned when initial memory of the module exceeds the limit
+var ErrMemoryLimit = errors.New("memory limit exceeded")
+
+var errInvalidModule = errors.New("invalid module")
+
+// memoryPages returns limit of linear memory in pages. 0 is unlimited
+func memoryPages(conf SrvConfig) uint32 {
+	if conf.WasmMaxMemory <= 0 {
+		return 0
+	}
+	return uint32(max(min(int64(conf.WasmMaxMemory)/wasmPageSize, math.MaxUint32), 1))
+}
+
+// wasmCursor reads WebAssembly binary
+type wasmCursor struct {
+	data []byte
+	pos  int
+}
+
+func (c *wasmCursor) byte() (byte, error) {
+	if c.pos >= len(c.data) {
+		return 0, errInvalidModule
+	}
+	c.pos++
+	return c.data[c.pos-1], nil
+}
+
+func (c *wasmCursor) u32() (uint32, error) {
+	v, n := binary.Uvarint(c.data[c.pos:])
+	if n <= 0 || v > math.MaxUint32 {
+		return 0, errInvalidModule
+	}
+	c.pos += n
+	return uint32(v), nil
+}
+
+func (c *wasmCursor) bytes(n int) ([]byte, error) {
+	if n < 0 || len(c.data)-c.pos < n {
+		return nil, errInvalidModule
+	}
+	c.pos += n
+	return c.data[c.pos-n : c.pos], nil
+}
+
+func (c *wasmCursor) name() error {
+	n, err := c.u32()
+	if err != nil {
+		return err
+	}
+	_, err = c.bytes(int(n))
+	return err
+}
+
+// limitMemory rewrites maximum of the linear memories defined or imported by the module.
+// memory.grow beyond the limit fails in every runtime
+func limitMemory(bytecode []byte, pages uint32) ([]byte, error) {
+	if len(bytecode) < 8 || !bytes.HasPrefix(bytecode, []byte("\x00asm")) {
+		return nil, errInvalidModule
+	}
+	res := bytes.Clone(bytecode[:8])
+	c := &wasmCursor{data: bytecode, pos: 8}
+	for c.pos < len(c.data) {
+		id, err := c.byte()
+		if err != nil {
+			return nil, err
+		}
+		size, err := c.u32()
+		if err != nil {
+			return nil, err
+		}
+		payload, err := c.bytes(int(size))
+		if err != nil {
+			return nil, err
+		}
+		switch id {
+		case wasmSectionImport:
+			payload, err = limitImports(payload, pages)
+		case wasmSectionMemory:
+			payload, err = limitMemories(payload, pages)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, id)
+		res = binary.AppendUvarint(res, uint64(len(payload)))
+		res = append(res, payload...)
+	}
+	return res, nil
+}
+
+// limitMemories rewrites the memory section
+func limitMemories(payload []byte, pages uint32) ([]byte, error) {
+	c := &wasmCursor{data: payload}
+	count, err := c.u32()
+	if err != nil {
+		return nil, err
+	}
+	res := binary.AppendUvarint(nil, uint64(count))
+	for range count {
+		if res, err = limitLimits(c, res, pages); err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+// limitImports rewrites memories in the import section
+func limitImports(payload []byte, pages uint32) ([]byte, error) {
+	c := &wasmCursor{data: payload}
+	count, err := c.u32()
+	if err != nil {
+		return nil, err
+	}
+	res := binary.AppendUvarint(nil, uint64(count))
+	for range count {
+		start := c.pos
+		if err := c.name(); err != nil {
+			return nil, err
+		}
+		if err := c.name(); err != nil {
+			return nil, err
+		}
+		kind, err := c.byte()
+		if err != nil {
+			return nil, err
+		}
+		switch kind {
+		case 0x00: // function: type index
+			_, err = c.u32()
+		case 0x01: // table: reftype, limits
+			if _, err = c.byte(); err == nil {
+				_, err = limitLimits(c, nil, math.MaxUint32)
+			}
+		case 0x02: // memory
+			res = append(res, payload[start:c.pos]...)
+			if res, err = limitLimits(c, res, pages); err != nil {
+				return nil, err
+			}
+			continue
+		case 0x03: // global: valtype, mutability
+			_, err = c.bytes(2)
+		case 0x04: // tag: attribute, type index
+			if _, err = c.byte(); err == nil {
+				_, err = c.u32()
+			}
+		default:
+			err = fmt.Errorf("%w: import kind %d", errInvalidModule, kind)
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, payload[start:c.pos]...)
+	}
+	return res, nil
+}
+
+// limitLimits reads limits and appends them with maximum lowered to pages
+func limitLimits(c *wasmCursor, res []byte, pages uint32) ([]byte, error) {
+	flags, err := c.byte()
+	if err != nil {
+		return nil, err
+	}
+	if flags&^0x03 != 0 {
+		// memory64 and others
+		return nil, fmt.Errorf("%w: unsupported limits %#x", errInvalidModule, flags)
+	}
+	minimum, err := c.u32()
+	if err != nil {
+		return nil, err
+	}
+	maximum := pages
+	if flags&0x01 != 0 {
+		declared, err := c.u32()
+		if err != nil {
+			return nil, err
+		}
+		maximum = min(declared, pages)
+	}
+	if minimum > maximum {
+		return nil, fmt.Errorf("%w: %d pages required", ErrMemoryLimit, minimum)
+	}
+	res = append(res, flags|0x01)
+	res = binary.AppendUvarint(res, uint64(minimum))
+	return binary.AppendUvarint(res, uint64(maximum)), nil
+}
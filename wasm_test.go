@@ -5,12 +5,152 @@ package main
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// loopWasm is a WASI module which exports "_start" running infinite loop
+var loopWasm = []byte{
+	0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00,
+	// type section: func() -> (), func(i32) -> ()
+	0x01, 0x08, 0x02, 0x60, 0x00, 0x00, 0x60, 0x01, 0x7f, 0x00,
+	// import section: wasi_snapshot_preview1.proc_exit
+	0x02, 0x24, 0x01, 0x16,
+	'w', 'a', 's', 'i', '_', 's', 'n', 'a', 'p', 's', 'h', 'o', 't', '_',
+	'p', 'r', 'e', 'v', 'i', 'e', 'w', '1',
+	0x09, 'p', 'r', 'o', 'c', '_', 'e', 'x', 'i', 't', 0x00, 0x01,
+	// function section
+	0x03, 0x02, 0x01, 0x00,
+	// memory section: 1 page
+	0x05, 0x03, 0x01, 0x00, 0x01,
+	// export section: "_start", "memory"
+	0x07, 0x13, 0x02,
+	0x06, '_', 's', 't', 'a', 'r', 't', 0x00, 0x01,
+	0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02, 0x00,
+	// code section: loop br 0 end
+	0x0a, 0x09, 0x01, 0x07, 0x00, 0x03, 0x40, 0x0c, 0x00, 0x0b, 0x0b,
+}
+
+// startWasm returns loopWasm with body of "_start" replaced. function 0 is proc_exit
+func startWasm(body ...byte) []byte {
+	res := bytes.Clone(loopWasm[:len(loopWasm)-11])
+	res = append(res, 0x0a, byte(len(body)+4), 0x01, byte(len(body)+2), 0x00)
+	return append(append(res, body...), 0x0b)
+}
+
+// buildWasm compiles Go source into WASI module
+func buildWasm(t *testing.T, output string, src string, flags ...string) {
+	srcdir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(srcdir, "main.go"), []byte(src), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	cmd := exec.Command("go", slices.Concat([]string{"build"}, flags, []string{"-o", output, "main.go"})...)
+	cmd.Dir = srcdir
+	cmd.Env = append(os.Environ(), "GOOS=wasip1", "GOARCH=wasm", "GOFLAGS=")
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatal("build wasm", err, string(out))
+	}
+}
+
+const readFileSrc = `package main
+
+import (
+	"fmt"
+	"os"
 )
 
+func main() {
+	fmt.Print("Content-Type: text/plain\n\n")
+	data, err := os.ReadFile("data.txt")
+	if err != nil {
+		fmt.Print("error ", err)
+		return
+	}
+	fmt.Print(string(data))
+}
+`
+
+const allocSrc = `package main
+
+import "fmt"
+
+func main() {
+	fmt.Print("Content-Type: text/plain\n\n")
+	buf := make([]byte, 64<<20)
+	buf[len(buf)-1] = 1
+	fmt.Print("allocated")
+}
+`
+
+const preopenSrc = `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Print("Content-Type: text/plain\n\n")
+	data, err := os.ReadFile("/data/in.txt")
+	if err != nil {
+		fmt.Print("error ", err)
+		return
+	}
+	fmt.Print(string(data))
+	if err := os.WriteFile("/data/out.txt", data, 0644); err != nil {
+		fmt.Print(" readonly")
+	}
+}
+`
+
+const streamSrc = `package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// request body is sent after the header
+func main() {
+	fmt.Print("Content-Type: text/plain\n\n")
+	n, _ := io.Copy(io.Discard, os.Stdin)
+	fmt.Print(n)
+}
+`
+
+const scratchSrc = `package main
+
+import (
+	"fmt"
+	"os"
+)
+
+func main() {
+	fmt.Print("Content-Type: text/plain\n\n")
+	fn := os.TempDir() + "/file.txt"
+	if err := os.WriteFile(fn, []byte("scratch"), 0644); err != nil {
+		fmt.Print("error ", err)
+		return
+	}
+	fmt.Print(fn)
+}
+`
+
 func testWasmOpenError(t *testing.T, runner Runner) {
 	conf := SrvConfig{SrvConfigBase{Timeout: time.Duration(1000_000_000)}}
 	fname := "test.wasm"
@@ -46,6 +186,333 @@ func testWasmHello(t *testing.T, runner Runner) {
 	}
 }
 
+func testWasmCancel(t *testing.T, runner Runner) {
+	conf := SrvConfig{}
+	conf.Timeout = time.Duration(10_000_000_000)
+	conf.BaseDir = t.TempDir()
+	fname := "loop.wasm"
+	if err := os.WriteFile(filepath.Join(conf.BaseDir, fname), loopWasm, 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	envvar := map[string]string{}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100*time.Millisecond, cancel)
+	err := runner.Run(conf, fname, envvar, stdin, stdout, stderr, ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("not cancelled %s", err)
+	}
+}
+
+func testWasmTimeout(t *testing.T, runner Runner) {
+	conf := SrvConfig{}
+	conf.Timeout = 100 * time.Millisecond
+	conf.BaseDir = t.TempDir()
+	if err := os.WriteFile(filepath.Join(conf.BaseDir, "loop.wasm"), loopWasm, 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	err := runner.Run(conf, "loop.wasm", map[string]string{}, stdin, &bytes.Buffer{}, &bytes.Buffer{}, context.Background())
+	if !errors.Is(err, ErrTimeout) || errorStatus(err) != 504 {
+		t.Errorf("not timed out %s", err)
+	}
+}
+
+func testWasmMemory(t *testing.T, runner Runner) {
+	// initial memory exceeds the limit
+	conf := SrvConfig{}
+	conf.BaseDir = "examples"
+	conf.WasmMaxMemory = wasmPageSize
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	err := runner.Run(conf, "hello.wasm", map[string]string{}, stdin, &bytes.Buffer{}, &bytes.Buffer{}, context.Background())
+	if !errors.Is(err, ErrMemoryLimit) {
+		t.Errorf("initial memory %s", err)
+	}
+}
+
+func testWasmMemoryGrow(t *testing.T, runner Runner) {
+	basedir := t.TempDir()
+	buildWasm(t, filepath.Join(basedir, "alloc.wasm"), allocSrc)
+	for _, tt := range []struct {
+		limit ByteSize
+		ok    bool
+	}{
+		{0, true},
+		{32 << 20, false},
+		{128 << 20, true},
+	} {
+		conf := SrvConfig{}
+		conf.Timeout = 10 * time.Second
+		conf.BaseDir = basedir
+		conf.WasmMaxMemory = tt.limit
+		stdin := io.NopCloser(bytes.NewBufferString(""))
+		stdout := &bytes.Buffer{}
+		err := runner.Run(conf, "alloc.wasm", map[string]string{}, stdin, stdout, &bytes.Buffer{}, context.Background())
+		if ok := strings.HasSuffix(stdout.String(), "allocated"); ok != tt.ok {
+			t.Errorf("limit %d: stdout %s, error %s", tt.limit, stdout.String(), err)
+		}
+	}
+}
+
+// testWasmWorkDir runs module reading data.txt relative to the working directory. build writes the module to the file
+func testWasmWorkDir(t *testing.T, runner Runner, build func(t *testing.T, filename string)) {
+	basedir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(basedir, "sub"), 0755); err != nil {
+		t.Fatal("mkdir", err)
+	}
+	build(t, filepath.Join(basedir, "sub", "readfile.wasm"))
+	if err := os.WriteFile(filepath.Join(basedir, "data.txt"), []byte("base"), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	if err := os.WriteFile(filepath.Join(basedir, "sub", "data.txt"), []byte("script"), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	for _, wd := range []string{"script", "base"} {
+		conf := SrvConfig{}
+		conf.Timeout = time.Duration(10_000_000_000)
+		conf.BaseDir = basedir
+		conf.WorkDir = wd
+		stdin := io.NopCloser(bytes.NewBufferString(""))
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+		err := runner.Run(conf, "sub/readfile.wasm", map[string]string{}, stdin, stdout, stderr, context.Background())
+		if err != nil {
+			t.Errorf("error %s", err)
+		}
+		if stdout.String() != "Content-Type: text/plain\n\n"+wd {
+			t.Errorf("%s: stdout %s", wd, stdout.String())
+		}
+	}
+}
+
+// testWasmPreopen runs module reading and writing preopened directory. returns stdout
+func testWasmPreopen(t *testing.T, runner Runner, mode string) (string, error) {
+	conf := SrvConfig{}
+	conf.Timeout = 10 * time.Second
+	conf.BaseDir = t.TempDir()
+	buildWasm(t, filepath.Join(conf.BaseDir, "preopen.wasm"), preopenSrc)
+	datadir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(datadir, "in.txt"), []byte("data"), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	if err := conf.applyOptions(map[string]any{"wasm-preopen": datadir + ":/data:" + mode}); err != nil {
+		t.Fatal("option", err)
+	}
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	stdout := &bytes.Buffer{}
+	err := runner.Run(conf, "preopen.wasm", map[string]string{}, stdin, stdout, &bytes.Buffer{}, context.Background())
+	_, staterr := os.Stat(filepath.Join(datadir, "out.txt"))
+	if (mode == "rw") != (staterr == nil) {
+		t.Errorf("%s: written %s", mode, staterr)
+	}
+	return stdout.String(), err
+}
+
+// streamWriter notifies the first write
+type streamWriter struct {
+	mu      sync.Mutex
+	buf     bytes.Buffer
+	written chan struct{}
+}
+
+func (w *streamWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.buf.Len() == 0 {
+		close(w.written)
+	}
+	return w.buf.Write(p)
+}
+
+func testWasmStream(t *testing.T, runner Runner) {
+	conf := SrvConfig{}
+	conf.Timeout = 30 * time.Second
+	conf.BaseDir = t.TempDir()
+	buildWasm(t, filepath.Join(conf.BaseDir, "stream.wasm"), streamSrc)
+	stdout := &streamWriter{written: make(chan struct{})}
+	// request body is sent after the header, as slow client does
+	stdin, pw := io.Pipe()
+	go func() {
+		select {
+		case <-stdout.written:
+		case <-time.After(10 * time.Second):
+		}
+		pw.Write(bytes.Repeat([]byte("x"), 1<<20))
+		pw.Close()
+	}()
+	errch := make(chan error, 1)
+	go func() {
+		errch <- runner.Run(conf, "stream.wasm", map[string]string{}, stdin, stdout, &bytes.Buffer{}, context.Background())
+	}()
+	// header is written while the module runs
+	select {
+	case <-stdout.written:
+	case err := <-errch:
+		t.Fatal("not streamed", err)
+	}
+	if err := <-errch; err != nil {
+		t.Error("error", err)
+	}
+	if stdout.buf.String() != "Content-Type: text/plain\n\n1048576" {
+		t.Error("stdout", stdout.buf.String())
+	}
+}
+
+func testWasmScratch(t *testing.T, runner Runner) {
+	conf := SrvConfig{}
+	conf.Timeout = time.Duration(10_000_000_000)
+	conf.BaseDir = t.TempDir()
+	buildWasm(t, filepath.Join(conf.BaseDir, "scratch.wasm"), scratchSrc)
+	tmpdir := t.TempDir()
+	ctx := withScratchDir(context.Background(), tmpdir)
+	stdin := io.NopCloser(bytes.NewBufferString(""))
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+	envvar := map[string]string{"TMPDIR": tmpdir}
+	err := runner.Run(conf, "scratch.wasm", envvar, stdin, stdout, stderr, ctx)
+	if err != nil {
+		t.Errorf("error %s", err)
+	}
+	if stdout.String() != "Content-Type: text/plain\n\n/tmp/file.txt" {
+		t.Errorf("stdout %s", stdout.String())
+	}
+	data, err := os.ReadFile(filepath.Join(tmpdir, "file.txt"))
+	if err != nil || string(data) != "scratch" {
+		t.Errorf("scratch file %s %s", data, err)
+	}
+}
+
+func testWasmExit(t *testing.T, runner Runner) {
+	conf := SrvConfig{}
+	conf.Timeout = 10 * time.Second
+	conf.BaseDir = t.TempDir()
+	tests := []struct {
+		name   string
+		module []byte
+		code   int // -1 is trap
+	}{
+		{"return", startWasm(), 0},
+		{"exit0", startWasm(0x41, 0, 0x10, 0), 0}, // i32.const 0; call proc_exit
+		{"exit3", startWasm(0x41, 3, 0x10, 0), 3}, // i32.const 3; call proc_exit
+		{"trap", startWasm(0x00), -1},             // unreachable
+		{"go", nil, 0},                            // Go guest exits by proc_exit(0)
+	}
+	for _, tt := range tests {
+		fname := tt.name + ".wasm"
+		if tt.module == nil {
+			buildWasm(t, filepath.Join(conf.BaseDir, fname), readFileSrc)
+		} else if err := os.WriteFile(filepath.Join(conf.BaseDir, fname), tt.module, 0644); err != nil {
+			t.Fatal("writefile", err)
+		}
+		sr := tracetest.NewSpanRecorder()
+		ctx, span := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(sr)).Tracer("").Start(context.Background(), "run")
+		stdin := io.NopCloser(bytes.NewBufferString(""))
+		err := runner.Run(conf, fname, map[string]string{}, stdin, &bytes.Buffer{}, &bytes.Buffer{}, ctx)
+		span.End()
+		events := sr.Ended()[0].Events()
+		var exitErr ExitCodeError
+		switch tt.code {
+		case 0:
+			if err != nil {
+				t.Error(tt.name, err)
+			}
+		case -1:
+			if err == nil || errors.As(err, &exitErr) || errorStatus(err) != http.StatusInternalServerError {
+				t.Error(tt.name, err)
+			}
+			if len(events) != 1 || events[0].Name != "trap" {
+				t.Error(tt.name, "events", events)
+			}
+		default:
+			if !errors.As(err, &exitErr) || exitErr.Code != tt.code || errorStatus(err) != http.StatusBadGateway {
+				t.Error(tt.name, err)
+			}
+		}
+		if tt.code != -1 && len(events) != 0 {
+			t.Error(tt.name, "events", events)
+		}
+	}
+}
+
+// testWasmCompile compiles scripts ahead of time, and runs them by a new runner sharing the cache dir.
+// corrupted artifacts are recompiled
+func testWasmCompile(t *testing.T, newRunner func(SrvConfig) Runner) {
+	conf := SrvConfig{}
+	conf.Timeout = 10 * time.Second
+	conf.BaseDir = t.TempDir()
+	if err := os.Mkdir(filepath.Join(conf.BaseDir, "sub"), 0755); err != nil {
+		t.Fatal("mkdir", err)
+	}
+	for _, fname := range []string{"return.wasm", "sub/exit3.wasm", "README"} {
+		module := startWasm()
+		if fname == "sub/exit3.wasm" {
+			module = startWasm(0x41, 3, 0x10, 0)
+		}
+		if err := os.WriteFile(filepath.Join(conf.BaseDir, fname), module, 0644); err != nil {
+			t.Fatal("writefile", err)
+		}
+	}
+	if err := compileScripts(conf, newRunner(conf)); err == nil {
+		t.Error("no cache dir")
+	}
+	conf.WasmCacheDir = t.TempDir()
+	if err := compileScripts(conf, newRunner(conf)); err != nil {
+		t.Error("compile", err)
+	}
+	artifacts := func() map[string][]byte {
+		res := map[string][]byte{}
+		err := filepath.WalkDir(conf.WasmCacheDir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			res[path] = data
+			return err
+		})
+		if err != nil {
+			t.Error("walk", err)
+		}
+		return res
+	}
+	if len(artifacts()) < 2 {
+		t.Error("artifacts", len(artifacts()))
+	}
+	run := func(name string) {
+		runner := newRunner(conf)
+		stdin := io.NopCloser(bytes.NewBufferString(""))
+		if err := runner.Run(conf, "return.wasm", map[string]string{}, stdin, &bytes.Buffer{}, &bytes.Buffer{}, context.Background()); err != nil {
+			t.Error(name, "return", err)
+		}
+		var exitErr ExitCodeError
+		stdin = io.NopCloser(bytes.NewBufferString(""))
+		if err := runner.Run(conf, "sub/exit3.wasm", map[string]string{}, stdin, &bytes.Buffer{}, &bytes.Buffer{}, context.Background()); !errors.As(err, &exitErr) || exitErr.Code != 3 {
+			t.Error(name, "exit3", err)
+		}
+	}
+	run("precompiled")
+	garbage := []byte("garbage")
+	for path := range artifacts() {
+		if err := os.WriteFile(path, garbage, 0644); err != nil {
+			t.Fatal("writefile", err)
+		}
+	}
+	run("corrupted")
+	for path, data := range artifacts() {
+		if bytes.Equal(data, garbage) {
+			t.Error("not recompiled", path)
+		}
+	}
+	// broken script fails, others are compiled
+	if err := os.WriteFile(filepath.Join(conf.BaseDir, "broken.wasm"), garbage, 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	if err := compileScripts(conf, newRunner(conf)); err == nil || !strings.Contains(err.Error(), "broken.wasm") {
+		t.Error("broken", err)
+	}
+}
+
 func testWasmAll(t *testing.T, runner Runner) {
 	t.Parallel()
 	t.Run("Hello", func(t *testing.T) {
@@ -56,4 +523,166 @@ func testWasmAll(t *testing.T, runner Runner) {
 		t.Parallel()
 		testWasmOpenError(t, runner)
 	})
+	t.Run("Cancel", func(t *testing.T) {
+		t.Parallel()
+		testWasmCancel(t, runner)
+	})
+	t.Run("Timeout", func(t *testing.T) {
+		t.Parallel()
+		testWasmTimeout(t, runner)
+	})
+	t.Run("Memory", func(t *testing.T) {
+		t.Parallel()
+		testWasmMemory(t, runner)
+	})
+	t.Run("Exit", func(t *testing.T) {
+		t.Parallel()
+		testWasmExit(t, runner)
+	})
+}
+
+func TestModuleCache(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	compiled := 0
+	evicted := []string{}
+	cache := newModuleCache(2, func(b []byte) (string, error) {
+		compiled++
+		return string(b), nil
+	}, func(v string) {
+		evicted = append(evicted, v)
+	})
+	write := func(name, content string) string {
+		fn := filepath.Join(dir, name)
+		if err := os.WriteFile(fn, []byte(content), 0644); err != nil {
+			t.Fatal("writefile", err)
+		}
+		return fn
+	}
+	fn1 := write("a.wasm", "a")
+	for range 2 {
+		if v, err := cache.get(fn1, 0); v != "a" || err != nil {
+			t.Error("get", v, err)
+		}
+	}
+	if compiled != 1 {
+		t.Error("compiled", compiled)
+	}
+	// modified file is recompiled
+	fn1 = write("a.wasm", "a2")
+	if v, err := cache.get(fn1, 0); v != "a2" || err != nil || compiled != 2 {
+		t.Error("modified", v, err, compiled)
+	}
+	// least recently used is evicted
+	fn2 := write("b.wasm", "b")
+	fn3 := write("c.wasm", "c")
+	cache.get(fn2, 0)
+	cache.get(fn1, 0)
+	cache.get(fn3, 0)
+	if !slices.Equal(evicted, []string{"a", "b"}) {
+		t.Error("evicted", evicted)
+	}
+	if _, err := cache.get(filepath.Join(dir, "notfound.wasm"), 0); err == nil {
+		t.Error("notfound")
+	}
+}
+
+func TestModuleCacheConcurrent(t *testing.T) {
+	t.Parallel()
+	fn := filepath.Join(t.TempDir(), "a.wasm")
+	if err := os.WriteFile(fn, []byte("a"), 0644); err != nil {
+		t.Fatal("writefile", err)
+	}
+	var compiled atomic.Int32
+	cache := newModuleCache(2, func(b []byte) (string, error) {
+		compiled.Add(1)
+		time.Sleep(100 * time.Millisecond)
+		return string(b), nil
+	}, nil)
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Go(func() {
+			if v, err := cache.get(fn, 0); v != "a" || err != nil {
+				t.Error("get", v, err)
+			}
+		})
+	}
+	wg.Wait()
+	if compiled.Load() != 1 {
+		t.Error("compiled", compiled.Load())
+	}
+}
+
+func TestLimitMemory(t *testing.T) {
+	t.Parallel()
+	res, err := limitMemory(loopWasm, 4)
+	if err != nil {
+		t.Fatal("limit", err)
+	}
+	if !bytes.Contains(res, []byte{0x05, 0x04, 0x01, 0x01, 0x01, 0x04}) || len(res) != len(loopWasm)+1 {
+		t.Error("memory section", res)
+	}
+	if _, err := limitMemory(loopWasm, 0); !errors.Is(err, ErrMemoryLimit) {
+		t.Error("initial", err)
+	}
+	header := []byte{0x00, 0x61, 0x73, 0x6d, 0x01, 0x00, 0x00, 0x00}
+	imported := func(limits ...byte) []byte {
+		payload := append([]byte{0x01, 0x03, 'e', 'n', 'v', 0x06, 'm', 'e', 'm', 'o', 'r', 'y', 0x02}, limits...)
+		return append(append(slices.Clone(header), 0x02, byte(len(payload))), payload...)
+	}
+	tests := []struct {
+		input  []byte
+		pages  uint32
+		output []byte
+	}{
+		{imported(0x00, 0x02), 3, imported(0x01, 0x02, 0x03)},
+		{imported(0x01, 0x01, 0x02), 8, imported(0x01, 0x01, 0x02)},
+		{imported(0x03, 0x01, 0x10), 8, imported(0x03, 0x01, 0x08)},
+	}
+	for _, tt := range tests {
+		if res, err := limitMemory(tt.input, tt.pages); err != nil || !bytes.Equal(res, tt.output) {
+			t.Error("import", tt.input, res, err)
+		}
+	}
+	if _, err := limitMemory([]byte("not wasm"), 1); err == nil {
+		t.Error("invalid")
+	}
+}
+
+func TestWasmPreopens(t *testing.T) {
+	t.Parallel()
+	conf := SrvConfig{}
+	conf.BaseDir = "base"
+	conf.WorkDir = "base"
+	err := conf.applyOptions(map[string]any{"wasm-preopen": []any{"/srv/data:/data:ro", "/srv/root:/:rw"}})
+	if err != nil {
+		t.Fatal("option", err)
+	}
+	res := wasmPreopens(conf, "script.wasm", context.Background())
+	expected := []wasmPreopen{
+		{Host: "base", Guest: "."},
+		{Host: "/srv/data", Guest: "/data", ReadOnly: true},
+		{Host: "/srv/root", Guest: "/"},
+	}
+	if !slices.Equal(res, expected) {
+		t.Error("preopens", res)
+	}
+	if err := writablePreopens(res, "test"); err == nil {
+		t.Error("read-only")
+	}
+	conf = SrvConfig{}
+	conf.routes = []routeConfig{{Path: "rw/*", Options: map[string]any{"wasm-preopen": "/srv/data:/data"}}}
+	if err := checkPreopens(conf, "test"); err != nil {
+		t.Error("writable", err)
+	}
+	conf.routes = append(conf.routes, routeConfig{Path: "ro/*", Options: map[string]any{"wasm-preopen": "/srv/data:/data:ro"}})
+	if err := checkPreopens(conf, "test"); err == nil || !strings.Contains(err.Error(), "ro/*") {
+		t.Error("read-only route", err)
+	}
+	for _, spec := range []string{"/data", ":/data", "/data:", "/data:/data:rx", "/a:/b:ro:x"} {
+		var p wasmPreopen
+		if err := p.UnmarshalFlag(spec); err == nil {
+			t.Error("invalid", spec, p)
+		}
+	}
 }
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrHeaderTimeout is the cause of cancellation when the script does not finish CGI headers in time
+	ErrHeaderTimeout = errors.New("header timeout")
+	// ErrIdleTimeout is the cause of cancellation when the script does not write stdout in time
+	ErrIdleTimeout = errors.New("idle timeout")
+)
+
+// scriptWatchdog watches stdout of the script and cancels the execution
+// when header timeout or idle timeout exceeded
+type scriptWatchdog struct {
+	output     io.Writer
+	idle       time.Duration
+	mu         sync.Mutex
+	headerDone bool
+	tail       []byte
+	headerTm   *time.Timer
+	idleTm     *time.Timer
+}
+
+// newScriptWatchdog starts timers. zero duration disables the timer
+func newScriptWatchdog(output io.Writer, header time.Duration, idle time.Duration,
+	cancel context.CancelCauseFunc) *scriptWatchdog {
+	res := &scriptWatchdog{
+		output: output,
+		idle:   idle,
+		// treat as if preceded by newline, to detect empty header
+		tail: []byte{'\n'},
+	}
+	if header > 0 {
+		res.headerTm = time.AfterFunc(header, func() {
+			slog.Warn("header timeout", "timeout", header)
+			cancel(fmt.Errorf("%w %v", ErrHeaderTimeout, header))
+		})
+	}
+	if idle > 0 {
+		res.idleTm = time.AfterFunc(idle, func() {
+			slog.Warn("idle timeout", "timeout", idle)
+			cancel(fmt.Errorf("%w %v", ErrIdleTimeout, idle))
+		})
+	}
+	return res
+}
+
+// checkHeader detects blank line which terminates CGI headers
+func (wd *scriptWatchdog) checkHeader(data []byte) {
+	if wd.headerDone {
+		return
+	}
+	buf := append(bytes.Clone(wd.tail), data...)
+	if bytes.Contains(buf, []byte("\n\n")) || bytes.Contains(buf, []byte("\n\r\n")) {
+		wd.headerDone = true
+		if wd.headerTm != nil {
+			wd.headerTm.Stop()
+		}
+		return
+	}
+	wd.tail = bytes.Clone(buf[max(len(buf)-2, 0):])
+}
+
+// Write implements io.Writer. the idle timer pauses while writing to output
+func (wd *scriptWatchdog) Write(data []byte) (int, error) {
+	wd.mu.Lock()
+	if wd.idleTm != nil {
+		wd.idleTm.Stop()
+	}
+	wd.checkHeader(data)
+	wd.mu.Unlock()
+	defer func() {
+		wd.mu.Lock()
+		defer wd.mu.Unlock()
+		if wd.idleTm != nil {
+			wd.idleTm.Reset(wd.idle)
+		}
+	}()
+	return wd.output.Write(data)
+}
+
+// Stop stops all timers
+func (wd *scriptWatchdog) Stop() {
+	wd.mu.Lock()
+	defer wd.mu.Unlock()
+	if wd.headerTm != nil {
+		wd.headerTm.Stop()
+	}
+	if wd.idleTm != nil {
+		wd.idleTm.Stop()
+		// not to be reset by Write
+		wd.idleTm = nil
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestWatchdogHeaderTimeout(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	out := &bytes.Buffer{}
+	wd := newScriptWatchdog(out, 50*time.Millisecond, 0, cancel)
+	defer wd.Stop()
+	fmt.Fprint(wd, "Content-Type: text/plain\n")
+	<-ctx.Done()
+	if !errors.Is(context.Cause(ctx), ErrHeaderTimeout) {
+		t.Error("cause", context.Cause(ctx))
+	}
+	if out.String() != "Content-Type: text/plain\n" {
+		t.Error("output", out.String())
+	}
+}
+
+func TestWatchdogHeaderDone(t *testing.T) {
+	t.Parallel()
+	inputs := map[string][]string{
+		"lf":    {"Content-Type: text/plain\n\nbody"},
+		"crlf":  {"Content-Type: text/plain\r\n", "\r\n"},
+		"split": {"Content-Type: text/plain\n", "\n"},
+		"empty": {"\n"},
+	}
+	for name, input := range inputs {
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			ctx, cancel := context.WithCancelCause(context.Background())
+			wd := newScriptWatchdog(&bytes.Buffer{}, 50*time.Millisecond, 0, cancel)
+			defer wd.Stop()
+			for _, v := range input {
+				fmt.Fprint(wd, v)
+			}
+			time.Sleep(100 * time.Millisecond)
+			if ctx.Err() != nil {
+				t.Error("cancelled", context.Cause(ctx))
+			}
+		})
+	}
+}
+
+func TestWatchdogIdleTimeout(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	wd := newScriptWatchdog(&bytes.Buffer{}, 0, 50*time.Millisecond, cancel)
+	defer wd.Stop()
+	for range 5 {
+		time.Sleep(20 * time.Millisecond)
+		fmt.Fprint(wd, "progress\n")
+	}
+	if ctx.Err() != nil {
+		t.Error("cancelled while progress", context.Cause(ctx))
+	}
+	<-ctx.Done()
+	if !errors.Is(context.Cause(ctx), ErrIdleTimeout) {
+		t.Error("cause", context.Cause(ctx))
+	}
+}
+
+func TestWatchdogStop(t *testing.T) {
+	t.Parallel()
+	ctx, cancel := context.WithCancelCause(context.Background())
+	wd := newScriptWatchdog(&bytes.Buffer{}, 20*time.Millisecond, 20*time.Millisecond, cancel)
+	wd.Stop()
+	fmt.Fprint(wd, "after stop\n")
+	time.Sleep(50 * time.Millisecond)
+	if ctx.Err() != nil {
+		t.Error("cancelled after stop", context.Cause(ctx))
+	}
+}